@@ -23,18 +23,35 @@ type Filesystem interface {
 	Rename(*Context, *RenameIn) error
 	Link(*Context, *LinkIn, *LinkOut) error
 	Open(*Context, *OpenIn, *OpenOut) error
+	Create(*Context, *CreateIn, *CreateOut) error
 	Read(*Context, *ReadIn, *ReadOut) error
+	Write(*Context, *WriteIn, *WriteOut) error
+	Statfs(*Context, *StatfsOut) error
 	Lseek(*Context, *LseekIn, *LseekOut) error
-	CopyFileRange(*Context, *CopyFileRangeIn) error
+	CopyFileRange(*Context, *CopyFileRangeIn, *WriteOut) error
+	Flush(*Context, *FlushIn) error
+	Fsync(*Context, *FsyncIn) error
 	Release(*Context, *ReleaseIn) error
+	Setxattr(*Context, *SetxattrIn) error
 	Getxattr(*Context, *GetxattrIn, *GetxattrOut) error
+	Listxattr(*Context, *ListxattrOut) error
+	Removexattr(*Context, *RemovexattrIn) error
+	Opendir(*Context, *OpendirIn, *OpendirOut) error
+	Readdir(*Context, *ReaddirIn, *ReaddirOut) error
+	Fsyncdir(*Context, *FsyncIn) error
+	Releasedir(*Context, *ReleaseIn) error
+	Getlk(*Context, *LkIn, *LkOut) error
+	Setlk(*Context, *LkIn) error
+	Setlkw(*Context, *LkIn) error
+	Readdirplus(*Context, *ReaddirplusIn, *ReaddirplusOut) error
+	Poll(*Context, *PollIn, *PollOut) error
+	Ioctl(*Context, *IoctlIn, *IoctlOut) error
+	Fallocate(*Context, *FallocateIn) error
 
 	// todo: what about *EntryOut? Less types?
 	/*Destroy(*Context, *DestroyIn, *DestroyOut) error
 	Access(*Context, *AccessIn, *AccessOut) error
-	Lookup(*Context, *LookupIn, *LookupOut) error
-	Opendir(*Context, *OpendirIn, *OpendirOut) error
-	Readdir(*Context, *ReaddirIn, *ReaddirOut) error*/
+	Lookup(*Context, *LookupIn, *LookupOut) error*/
 
 	/*
 		Lookup(r Request, name string) (EntryOut, error)
@@ -131,15 +148,35 @@ func (f HandlerFunc) Open(ctx *Context, in *OpenIn, out *OpenOut) error {
 	return f(ctx, in, out)
 }
 
+func (f HandlerFunc) Create(ctx *Context, in *CreateIn, out *CreateOut) error {
+	return f(ctx, in, out)
+}
+
 func (f HandlerFunc) Read(ctx *Context, in *ReadIn, out *ReadOut) error {
 	return f(ctx, in, out)
 }
 
+func (f HandlerFunc) Write(ctx *Context, in *WriteIn, out *WriteOut) error {
+	return f(ctx, in, out)
+}
+
+func (f HandlerFunc) Statfs(ctx *Context, out *StatfsOut) error {
+	return f(ctx, nil, out)
+}
+
 func (f HandlerFunc) Lseek(ctx *Context, in *LseekIn, out *LseekOut) error {
 	return f(ctx, in, out)
 }
 
-func (f HandlerFunc) CopyFileRange(ctx *Context, in *CopyFileRangeIn) error {
+func (f HandlerFunc) CopyFileRange(ctx *Context, in *CopyFileRangeIn, out *WriteOut) error {
+	return f(ctx, in, out)
+}
+
+func (f HandlerFunc) Flush(ctx *Context, in *FlushIn) error {
+	return f(ctx, in, nil)
+}
+
+func (f HandlerFunc) Fsync(ctx *Context, in *FsyncIn) error {
 	return f(ctx, in, nil)
 }
 
@@ -147,14 +184,86 @@ func (f HandlerFunc) Release(ctx *Context, in *ReleaseIn) error {
 	return f(ctx, in, nil)
 }
 
+func (f HandlerFunc) Setxattr(ctx *Context, in *SetxattrIn) error {
+	return f(ctx, in, nil)
+}
+
 func (f HandlerFunc) Getxattr(ctx *Context, in *GetxattrIn, out *GetxattrOut) error {
 	return f(ctx, in, out)
 }
 
+func (f HandlerFunc) Listxattr(ctx *Context, out *ListxattrOut) error {
+	return f(ctx, nil, out)
+}
+
+func (f HandlerFunc) Removexattr(ctx *Context, in *RemovexattrIn) error {
+	return f(ctx, in, nil)
+}
+
+func (f HandlerFunc) Opendir(ctx *Context, in *OpendirIn, out *OpendirOut) error {
+	return f(ctx, in, out)
+}
+
+func (f HandlerFunc) Readdir(ctx *Context, in *ReaddirIn, out *ReaddirOut) error {
+	return f(ctx, in, out)
+}
+
+func (f HandlerFunc) Fsyncdir(ctx *Context, in *FsyncIn) error {
+	return f(ctx, in, nil)
+}
+
+func (f HandlerFunc) Releasedir(ctx *Context, in *ReleaseIn) error {
+	return f(ctx, in, nil)
+}
+
+func (f HandlerFunc) Readdirplus(ctx *Context, in *ReaddirplusIn, out *ReaddirplusOut) error {
+	return f(ctx, in, out)
+}
+
+func (f HandlerFunc) Getlk(ctx *Context, in *LkIn, out *LkOut) error {
+	return f(ctx, in, out)
+}
+
+func (f HandlerFunc) Setlk(ctx *Context, in *LkIn) error {
+	return f(ctx, in, nil)
+}
+
+func (f HandlerFunc) Setlkw(ctx *Context, in *LkIn) error {
+	return f(ctx, in, nil)
+}
+
+func (f HandlerFunc) Poll(ctx *Context, in *PollIn, out *PollOut) error {
+	return f(ctx, in, out)
+}
+
+func (f HandlerFunc) Ioctl(ctx *Context, in *IoctlIn, out *IoctlOut) error {
+	return f(ctx, in, out)
+}
+
+func (f HandlerFunc) Fallocate(ctx *Context, in *FallocateIn) error {
+	return f(ctx, in, nil)
+}
+
 var DefaultFilesystem = HandlerFunc(func(ctx *Context, req Request, resp Response) error {
 	switch ctx.Op {
-	case proto.INIT:
+	case proto.INIT, proto.DESTROY:
+		return nil
+	case proto.STATFS:
+		// report an empty filesystem, rather than failing statfs(2)
+		*resp.(*StatfsOut) = StatfsOut{
+			Bsize:   512,
+			Namelen: 255,
+		}
 		return nil
+	case proto.GETLK:
+		return ctx.sess.locks.Getlk(ctx, req.(*LkIn), resp.(*LkOut))
+	case proto.SETLK:
+		return ctx.sess.locks.Setlk(ctx, req.(*LkIn))
+	case proto.SETLKW:
+		return ctx.sess.locks.Setlkw(ctx, req.(*LkIn))
+	case proto.FALLOCATE:
+		// the errno expected by callers of fallocate(2)
+		return EOPNOTSUPP
 	default:
 		return ENOSYS
 	}
@@ -0,0 +1,185 @@
+package fuse
+
+import (
+	"context"
+	"time"
+)
+
+var _ context.Context = (*Context)(nil)
+
+// contextKey is a value for use with Context.Value.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "fuse context value " + k.name }
+
+var (
+	// UIDContextKey is a context key. It can be used to access the user ID
+	// of the calling process. The associated value is of type uint32.
+	UIDContextKey = &contextKey{"uid"}
+
+	// GIDContextKey is a context key. It can be used to access the group ID
+	// of the calling process. The associated value is of type uint32.
+	GIDContextKey = &contextKey{"gid"}
+
+	// PIDContextKey is a context key. It can be used to access the ID of the
+	// calling process. The associated value is of type uint32.
+	PIDContextKey = &contextKey{"pid"}
+)
+
+// closedchan is a reusable closed channel.
+var closedchan = make(chan struct{})
+
+func init() {
+	close(closedchan)
+}
+
+// Interrupt returns a channel that is closed when the kernel interrupts the
+// request, typically because the calling process received a signal, or when the
+// session is forcefully shut down. Handlers blocked on a slow operation should
+// abandon it and return EINTR.
+//
+// Unlike Done, the channel is not closed when the request's deadline expires.
+func (ctx *Context) Interrupt() <-chan struct{} {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.intr == nil {
+		if ctx.interrupted {
+			ctx.intr = closedchan
+		} else {
+			ctx.intr = make(chan struct{})
+		}
+	}
+	return ctx.intr
+}
+
+// Deadline reports when the request must be replied to, as configured by
+// Options.RequestTimeout. There is no deadline by default.
+func (ctx *Context) Deadline() (deadline time.Time, ok bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.deadline, !ctx.deadline.IsZero()
+}
+
+// Done returns a channel that is closed when the request is interrupted, its
+// deadline expires, or the handler returns. A Context must not be used after
+// its handler returns.
+func (ctx *Context) Done() <-chan struct{} {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.done == nil {
+		ctx.expire()
+	}
+	if ctx.done == nil {
+		ctx.done = make(chan struct{})
+
+		// the deadline timer is only needed once someone is listening
+		if !ctx.deadline.IsZero() {
+			gen := ctx.gen
+			ctx.timer = time.AfterFunc(time.Until(ctx.deadline), func() {
+				ctx.mu.Lock()
+				defer ctx.mu.Unlock()
+				if ctx.gen == gen {
+					ctx.cancelLocked(context.DeadlineExceeded)
+				}
+			})
+		}
+	}
+	return ctx.done
+}
+
+// Err returns context.Canceled if the request has been interrupted or
+// cancelled, or context.DeadlineExceeded if its deadline has passed.
+func (ctx *Context) Err() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.expire()
+	return ctx.err
+}
+
+// Value returns the caller's credentials for UIDContextKey, GIDContextKey and
+// PIDContextKey, or nil for any other key.
+func (ctx *Context) Value(key interface{}) interface{} {
+	switch key {
+	case UIDContextKey:
+		return ctx.UID
+	case GIDContextKey:
+		return ctx.GID
+	case PIDContextKey:
+		return ctx.PID
+	}
+	return nil
+}
+
+// reset prepares the cancellation state for a new request
+func (ctx *Context) reset(deadline time.Time) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.done = nil
+	ctx.err = nil
+	ctx.intr = nil
+	ctx.interrupted = false
+	ctx.deadline = deadline
+	ctx.timer = nil
+	ctx.gen++
+}
+
+// interrupt closes the Interrupt channel, and cancels the request
+func (ctx *Context) interrupt() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if !ctx.interrupted {
+		ctx.interrupted = true
+		if ctx.intr != nil {
+			close(ctx.intr)
+		}
+	}
+	ctx.cancelLocked(context.Canceled)
+}
+
+func (ctx *Context) cancelLocked(err error) {
+	if ctx.err != nil {
+		return
+	}
+	ctx.err = err
+	if ctx.done == nil {
+		ctx.done = closedchan
+	} else {
+		close(ctx.done)
+	}
+	if ctx.timer != nil {
+		ctx.timer.Stop()
+	}
+}
+
+// cancel the request if its deadline has passed
+func (ctx *Context) expire() {
+	if !ctx.deadline.IsZero() && !time.Now().Before(ctx.deadline) {
+		ctx.cancelLocked(context.DeadlineExceeded)
+	}
+}
+
+// yield gives up the handler's worker while it's blocked, such as waiting for
+// a lock, so that other requests may be handled. It has no effect if the
+// handler has no worker.
+func (ctx *Context) yield() {
+	if ctx.worker {
+		ctx.worker = false
+		ctx.yielded = true
+		<-ctx.sess.workers
+	}
+}
+
+// resume reacquires a worker given up by yield
+func (ctx *Context) resume() {
+	if ctx.yielded {
+		ctx.yielded = false
+		ctx.sess.workers <- struct{}{}
+		ctx.worker = true
+	}
+}
@@ -0,0 +1,54 @@
+package fuse
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestContextDeadline(t *testing.T) {
+	ctx := &Context{Header: &Header{UID: 1000}}
+	ctx.reset(time.Now().Add(10 * time.Millisecond))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("deadline did not expire")
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+	select {
+	case <-ctx.Interrupt():
+		t.Error("deadline should not interrupt the request")
+	default:
+	}
+	if uid, _ := ctx.Value(UIDContextKey).(uint32); uid != 1000 {
+		t.Errorf("unexpected uid %v", ctx.Value(UIDContextKey))
+	}
+}
+
+func TestContextInterrupt(t *testing.T) {
+	ctx := &Context{Header: &Header{}}
+	ctx.reset(time.Time{})
+
+	intr := ctx.Interrupt()
+	ctx.interrupt()
+
+	for _, c := range []<-chan struct{}{intr, ctx.Done(), ctx.Interrupt()} {
+		select {
+		case <-c:
+		default:
+			t.Error("channel not closed after interrupt")
+		}
+	}
+	if err := ctx.Err(); err != context.Canceled {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+
+	// a reused context starts out uncancelled
+	ctx.reset(time.Time{})
+	if ctx.Err() != nil {
+		t.Error("reset context is cancelled")
+	}
+}
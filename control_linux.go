@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -18,39 +19,268 @@ import (
 	"bytelog.org/fuse/proto"
 )
 
-func mount(target string) (*os.File, error) {
-	return usermount(target, Options{})
+// mount target, directly if privileged, and otherwise with fusermount.
+func mount(target string, options *Options) (*os.File, io.Closer, error) {
+	opts, err := options.mountOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// only fusermount can unmount once the process exits
+	if !options.AutoUnmount {
+		dev, err := kernelmount(target, options)
+		if !errors.Is(err, unix.EPERM) {
+			return dev, nil, err
+		}
+	}
+	return usermount(target, opts, options.AutoUnmount)
+}
+
+// umount target, directly if privileged, and otherwise with fusermount. A lazy
+// unmount detaches the filesystem even if it is busy.
+func umount(target string, lazy bool) error {
+	flags := 0
+	if lazy {
+		flags = unix.MNT_DETACH
+	}
+	err := unix.Unmount(target, flags)
+	if errors.Is(err, unix.EPERM) {
+		return userumount(target, lazy)
+	}
+	if err != nil {
+		return &os.PathError{Op: "umount", Path: target, Err: err}
+	}
+	return nil
+}
+
+// device returns a duplicate of the pre-opened device given by options or
+// target, or nil if the target should be mounted.
+func device(options *Options, target string) (*os.File, error) {
+	fd := -1
+	switch {
+	case options.Device != nil:
+		rawConn, err := options.Device.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		var dupErr error
+		err = rawConn.Control(func(devFD uintptr) {
+			fd, dupErr = unix.FcntlInt(devFD, unix.F_DUPFD_CLOEXEC, 0)
+		})
+		if err = firstErr(err, dupErr); err != nil {
+			return nil, err
+		}
+	case options.FD > 0:
+		n, err := unix.FcntlInt(uintptr(options.FD), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%w: FD %d: %v", ErrInvalidOption, options.FD, err)
+		}
+		fd = n
+	case strings.HasPrefix(target, "/dev/fd/"):
+		n, err := strconv.Atoi(strings.TrimPrefix(target, "/dev/fd/"))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: bad target %s", ErrInvalidOption, target)
+		}
+		if n, err = unix.FcntlInt(uintptr(n), unix.F_DUPFD_CLOEXEC, 0); err != nil {
+			return nil, fmt.Errorf("%w: target %s: %v", ErrInvalidOption, target, err)
+		}
+		fd = n
+	default:
+		return nil, nil
+	}
+
+	// also applies to the caller's descriptor, as documented on Options.FD
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/fuse"), nil
+}
+
+// mountOptions encodes options for the mount helper. The helper determines
+// rootmode, user_id and group_id on its own.
+func (o *Options) mountOptions() (string, error) {
+	if o.AllowOther && o.AllowRoot {
+		const format = "%w: AllowOther and AllowRoot are mutually exclusive"
+		return "", fmt.Errorf(format, ErrInvalidOption)
+	}
+	if o.BlockSize < 0 || o.MaxRead < 0 {
+		const format = "%w: BlockSize (%d) and MaxRead (%d) cannot be negative"
+		return "", fmt.Errorf(format, ErrInvalidOption, o.BlockSize, o.MaxRead)
+	}
+	if o.BlockSize > 0 && !o.BlockDevice {
+		const format = "%w: BlockSize requires BlockDevice"
+		return "", fmt.Errorf(format, ErrInvalidOption)
+	}
+
+	opts := o.kernelOptions()
+	if o.BlockDevice {
+		opts = append(opts, "blkdev")
+	}
+	if o.FSName != "" {
+		opts = append(opts, "fsname="+escapeOption(o.FSName))
+	}
+	if o.SubType != "" {
+		opts = append(opts, "subtype="+escapeOption(o.SubType))
+	}
+	if o.AutoUnmount {
+		opts = append(opts, "auto_unmount")
+	}
+	return strings.Join(opts, ","), nil
+}
+
+// kernelOptions encodes the options understood by the kernel, other than those
+// describing the mount itself.
+func (o *Options) kernelOptions() []string {
+	var opts []string
+	if o.DefaultPermissions {
+		opts = append(opts, "default_permissions")
+	}
+	// allow_root is enforced by the session, see session.denied
+	if o.AllowOther || o.AllowRoot {
+		opts = append(opts, "allow_other")
+	}
+	if o.BlockSize > 0 {
+		opts = append(opts, "blksize="+strconv.Itoa(o.BlockSize))
+	}
+	if o.MaxRead > 0 {
+		opts = append(opts, "max_read="+strconv.Itoa(o.MaxRead))
+	}
+	return opts
 }
 
-func umount(target string) error {
-	return userumount(target, false)
+// commas separate options, so they must be escaped along with backslashes
+var optionEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`)
+
+func escapeOption(s string) string {
+	return optionEscaper.Replace(s)
 }
 
-func usermount(target string, options Options) (dev *os.File, err error) {
+// usermount mounts target with fusermount. With autoUnmount, fusermount keeps
+// running until the returned io.Closer is closed, or the process exits, and
+// then unmounts target.
+func usermount(target, options string, autoUnmount bool) (dev *os.File, monitor io.Closer, err error) {
 	pair, err := unixPair(unix.SOCK_STREAM)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer closeErr(pair[0], &err)
-	defer closeErr(pair[1], &err)
 
 	cmd := exec.Command("fusermount", target)
+	if options != "" {
+		cmd.Args = append(cmd.Args, "-o", options)
+	}
 	cmd.Env = []string{"_FUSE_COMMFD=3"}
 	cmd.ExtraFiles = pair[1:]
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
-	if err = cmd.Run(); err != nil {
-		return nil, errors.New(stderr.String())
+	mountErr := func(err error) error {
+		return &MountError{
+			Target:  target,
+			Options: options,
+			Msg:     strings.TrimSpace(stderr.String()),
+			Err:     err,
+		}
+	}
+
+	// our end of the child's socket must be closed, so that reads fail once
+	// the child exits
+	err = cmd.Start()
+	_ = pair[1].Close()
+	if err != nil {
+		return nil, nil, mountErr(err)
 	}
 
 	conn, err := net.FileConn(pair[0])
 	if err != nil {
-		return nil, err
+		_ = cmd.Wait()
+		return nil, nil, err
+	}
+	dev, err = receiveDev(conn.(*net.UnixConn))
+
+	if !autoUnmount || err != nil {
+		_ = conn.Close()
+		if werr := cmd.Wait(); werr != nil {
+			if dev != nil {
+				_ = dev.Close()
+			}
+			return nil, nil, mountErr(werr)
+		}
+		return dev, nil, err
+	}
+	return dev, &fusermount{conn: conn, cmd: cmd}, nil
+}
+
+// a fusermount process monitoring the mount for auto_unmount
+type fusermount struct {
+	conn net.Conn
+	cmd  *exec.Cmd
+}
+
+// Close signals fusermount to unmount, and waits for it to exit.
+func (m *fusermount) Close() error {
+	return firstErr(m.conn.Close(), m.cmd.Wait())
+}
+
+// kernelmount opens /dev/fuse and mounts target with mount(2), which requires
+// CAP_SYS_ADMIN. Fails with EPERM if the caller is not privileged.
+func kernelmount(target string, o *Options) (dev *os.File, err error) {
+	var st unix.Stat_t
+	if err := unix.Stat(target, &st); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: target, Err: err}
+	}
+
+	fd, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/fuse", Err: err}
 	}
-	defer closeErr(conn, &err)
-	return receiveDev(conn.(*net.UnixConn))
+	dev = os.NewFile(uintptr(fd), "/dev/fuse")
+	defer closeOnErr(dev, &err)
+
+	rootmode := o.RootMode
+	if rootmode == 0 {
+		rootmode = st.Mode & unix.S_IFMT
+	}
+	uid, gid := o.UID, o.GID
+	if uid == 0 {
+		uid = os.Getuid()
+	}
+	if gid == 0 {
+		gid = os.Getgid()
+	}
+
+	opts := append([]string{
+		"fd=" + strconv.Itoa(fd),
+		"rootmode=" + strconv.FormatUint(uint64(rootmode), 8),
+		"user_id=" + strconv.Itoa(uid),
+		"group_id=" + strconv.Itoa(gid),
+	}, o.kernelOptions()...)
+	data := strings.Join(opts, ",")
+
+	fstype := "fuse"
+	if o.BlockDevice {
+		fstype = "fuseblk"
+	}
+	if o.SubType != "" {
+		fstype += "." + o.SubType
+	}
+
+	source := o.FSName
+	if source == "" {
+		source = fstype
+	}
+
+	err = unix.Mount(source, target, fstype, unix.MS_NOSUID|unix.MS_NODEV, data)
+	if err != nil {
+		return nil, &MountError{
+			Target:  target,
+			Options: data,
+			Err:     err,
+		}
+	}
+	return dev, nil
 }
 
 func userumount(target string, lazy bool) error {
@@ -64,7 +294,10 @@ func userumount(target string, lazy bool) error {
 	cmd.Stderr = &stderr
 
 	if err := cmd.Run(); err != nil {
-		return errors.New(stderr.String())
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
 	}
 	return nil
 }
@@ -138,15 +371,22 @@ func clone(dev *os.File) (clone *os.File, err error) {
 	return os.NewFile(uintptr(cloneFD), "/dev/fuse"), nil
 }
 
+// deviceNumber finds the fusectl connection number of the filesystem mounted at
+// target, which is the minor number of its anonymous device.
 func deviceNumber(target string) (int, error) {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return 0, err
+	}
+
 	f, err := os.Open("/proc/self/mountinfo")
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	defer f.Close()
 
 	// https://www.kernel.org/doc/Documentation/filesystems/proc.txt
-	const expr = `^[^:]+:(\d+) \S+ %s .+ - fuse /dev/fuse`
+	const expr = `^[^:]+:(\d+) \S+ %s .+ - fuse(blk)?(\.\S+)? `
 	re := regexp.MustCompile(fmt.Sprintf(expr, regexp.QuoteMeta(target)))
 
 	scanner := bufio.NewScanner(f)
@@ -161,12 +401,13 @@ func deviceNumber(target string) (int, error) {
 	return 0, fmt.Errorf("%s not found in mountinfo", target)
 }
 
-func fusectl_abort(device int) error {
+func fusectl_abort(device int) (err error) {
 	path := fmt.Sprintf("/sys/fs/fuse/connections/%d/abort", device)
 	f, err := os.OpenFile(path, os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
+	defer closeErr(f, &err)
 	_, err = io.WriteString(f, "1")
 	return err
 }
@@ -0,0 +1,65 @@
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMountOptions(t *testing.T) {
+	o := Options{
+		AllowOther:  true,
+		MaxRead:     131072,
+		FSName:      `a,b\c`,
+		SubType:     "mem",
+		AutoUnmount: true,
+	}
+	opts, err := o.mountOptions()
+	assert(t, err)
+	const expected = `allow_other,max_read=131072,fsname=a\,b\\c,subtype=mem,auto_unmount`
+	if opts != expected {
+		t.Errorf("expected %s, got %s", expected, opts)
+	}
+
+	for _, o := range []Options{
+		{AllowOther: true, AllowRoot: true},
+		{BlockSize: 4096},
+		{MaxRead: -1},
+	} {
+		if _, err := o.mountOptions(); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("expected ErrInvalidOption for %+v, got %v", o, err)
+		}
+	}
+}
+
+func TestDevice(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	for _, tc := range []struct {
+		options Options
+		target  string
+	}{
+		{Options{Device: r}, "/tmp/mnt"},
+		{Options{FD: int(r.Fd())}, "/tmp/mnt"},
+		{Options{}, fmt.Sprintf("/dev/fd/%d", r.Fd())},
+	} {
+		dev, err := device(&tc.options, tc.target)
+		assert(t, err)
+		if dev == nil || dev.Fd() == r.Fd() {
+			t.Errorf("expected a duplicate of fd %d for %+v", r.Fd(), tc)
+			continue
+		}
+		_ = dev.Close()
+	}
+
+	if dev, err := device(&Options{}, "/tmp/mnt"); dev != nil || err != nil {
+		t.Errorf("expected no device, got %v, %v", dev, err)
+	}
+	if _, err := device(&Options{}, "/dev/fd/x"); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("expected ErrInvalidOption, got %v", err)
+	}
+}
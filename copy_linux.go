@@ -0,0 +1,31 @@
+package fuse
+
+import (
+	"math"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopyFileRange handles a COPY_FILE_RANGE request for file handles backed by
+// the host files fdIn and fdOut, copying the range with copy_file_range(2) so
+// that the data never passes through the process. A short copy is reported
+// in out, as for a short write.
+//
+// Errors are returned as their errno. The kernel falls back to copying the
+// data itself through READ and WRITE requests on EXDEV and EOPNOTSUPP.
+func CopyFileRange(fdIn, fdOut int, in *CopyFileRangeIn, out *WriteOut) error {
+	offIn := int64(in.OffIn)
+	offOut := int64(in.OffOut)
+
+	// the number of bytes copied is replied with 32 bits
+	n := in.Len
+	if n > math.MaxUint32 {
+		n = math.MaxUint32
+	}
+	copied, err := unix.CopyFileRange(fdIn, &offIn, fdOut, &offOut, int(n), int(in.Flags))
+	if err != nil {
+		return err
+	}
+	out.Size = uint32(copied)
+	return nil
+}
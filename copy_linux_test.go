@@ -0,0 +1,43 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCopyFileRange(t *testing.T) {
+	src, err := ioutil.TempFile("", "fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	dst, err := ioutil.TempFile("", "fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if _, err := src.WriteString("hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	in := &CopyFileRangeIn{OffIn: 6, OffOut: 2, Len: 64}
+	out := &WriteOut{}
+	if err := CopyFileRange(int(src.Fd()), int(dst.Fd()), in, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Size != 5 {
+		t.Errorf("expected 5 bytes copied, got %d", out.Size)
+	}
+	data, err := ioutil.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "\x00\x00world" {
+		t.Errorf("unexpected data %q", data)
+	}
+}
@@ -178,7 +178,6 @@ func (fs *FS) Getattr(ctx *fuse.Context, in *fuse.GetattrIn, out *fuse.GetattrOu
 }
 
 // Get an extended attribute of a node
-// in.Size: maximum size of the value to send
 func (fs *FS) Getxattr(ctx *fuse.Context, in *fuse.GetxattrIn, out *fuse.GetxattrOut) error {
 	fs.nodeMu.RLock()
 	defer fs.nodeMu.RUnlock()
@@ -188,7 +187,9 @@ func (fs *FS) Getxattr(ctx *fuse.Context, in *fuse.GetxattrIn, out *fuse.Getxatt
 		return fuse.ENOENT
 	}
 
-	out.Value, _ = node.Getxattr(in.Name)
+	if out.Value, ok = node.Getxattr(in.Name); !ok {
+		return fuse.ENODATA
+	}
 	return nil
 }
 
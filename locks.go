@@ -0,0 +1,248 @@
+package fuse
+
+import (
+	"math"
+	"sync"
+	"syscall"
+)
+
+var (
+	EAGAIN = syscall.EAGAIN
+	EINTR  = syscall.EINTR
+)
+
+// LockManager implements POSIX record locks and BSD flock locks on behalf of a
+// filesystem, including conflict detection, splitting and merging of ranges,
+// and blocking lock requests. The zero value is ready to use.
+//
+// Filesystems built on DefaultFilesystem use a LockManager owned by the
+// session, which is released automatically on FLUSH and RELEASE.
+//
+// Filesystems that manage their own LockManager should forward Getlk, Setlk
+// and Setlkw to it, and call ReleaseOwner from Flush and Release.
+type LockManager struct {
+	mu    sync.Mutex
+	nodes map[uint64]*lockNode
+}
+
+type lockNode struct {
+	posix lockList
+	flock lockList
+
+	// closed whenever locks are released, waking any blocked Setlkw
+	wait chan struct{}
+}
+
+type lockList []lockRange
+
+// an inclusive range of bytes held by owner
+type lockRange struct {
+	start uint64
+	end   uint64
+	typ   uint32
+	pid   uint32
+	owner uint64
+}
+
+// Getlk reports the first lock that conflicts with in.Lk, or a lock of type
+// F_UNLCK if there is none.
+func (m *LockManager) Getlk(ctx *Context, in *LkIn, out *LkOut) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out.Lk = in.Lk
+	out.Lk.Type = syscall.F_UNLCK
+
+	node := m.nodes[ctx.NodeID]
+	if node == nil {
+		return nil
+	}
+	if r, ok := node.list(in).conflict(in.Owner, in.Lk); ok {
+		out.Lk = FileLock{
+			Start: r.start,
+			End:   r.end,
+			Type:  r.typ,
+			PID:   r.pid,
+		}
+	}
+	return nil
+}
+
+// Setlk acquires or releases a lock, failing with EAGAIN if the lock is held
+// by another owner.
+func (m *LockManager) Setlk(ctx *Context, in *LkIn) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.trySet(ctx.NodeID, in); !ok {
+		return EAGAIN
+	}
+	return nil
+}
+
+// Setlkw acquires or releases a lock, waiting for conflicting locks to be
+// released. Returns EINTR if the request is interrupted while waiting.
+func (m *LockManager) Setlkw(ctx *Context, in *LkIn) error {
+	for {
+		m.mu.Lock()
+		wait, ok := m.trySet(ctx.NodeID, in)
+		m.mu.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		// other handlers may need a worker to release the lock
+		ctx.yield()
+		select {
+		case <-wait:
+		case <-ctx.Interrupt():
+			ctx.resume()
+			return EINTR
+		}
+		ctx.resume()
+	}
+}
+
+// ReleaseOwner releases all locks held by owner on node. If flock is set, BSD
+// flock locks are released, otherwise POSIX record locks are released.
+func (m *LockManager) ReleaseOwner(node, owner uint64, flock bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.nodes[node]
+	if n == nil {
+		return
+	}
+
+	unlock := lockRange{
+		start: 0,
+		end:   math.MaxUint64,
+		typ:   syscall.F_UNLCK,
+		owner: owner,
+	}
+	if flock {
+		n.flock = n.flock.set(unlock)
+	} else {
+		n.posix = n.posix.set(unlock)
+	}
+	m.wake(node, n)
+}
+
+// trySet applies the lock if there is no conflict. Otherwise, returns a channel
+// which is closed when locks on the node are next released.
+func (m *LockManager) trySet(nodeid uint64, in *LkIn) (<-chan struct{}, bool) {
+	if m.nodes == nil {
+		m.nodes = make(map[uint64]*lockNode)
+	}
+	node := m.nodes[nodeid]
+	if node == nil {
+		node = &lockNode{}
+		m.nodes[nodeid] = node
+	}
+
+	list := node.list(in)
+	if in.Lk.Type != syscall.F_UNLCK {
+		if _, ok := list.conflict(in.Owner, in.Lk); ok {
+			if node.wait == nil {
+				node.wait = make(chan struct{})
+			}
+			return node.wait, false
+		}
+	}
+
+	*list = list.set(lockRange{
+		start: in.Lk.Start,
+		end:   in.Lk.End,
+		typ:   in.Lk.Type,
+		pid:   in.Lk.PID,
+		owner: in.Owner,
+	})
+
+	// any change may release a range that a waiter is blocked on
+	m.wake(nodeid, node)
+	return nil, true
+}
+
+// wake any waiters, and forget the node once it holds no locks
+func (m *LockManager) wake(nodeid uint64, node *lockNode) {
+	if node.wait != nil {
+		close(node.wait)
+		node.wait = nil
+	}
+	if len(node.posix) == 0 && len(node.flock) == 0 {
+		delete(m.nodes, nodeid)
+	}
+}
+
+func (n *lockNode) list(in *LkIn) *lockList {
+	if in.LkFlags.Flock() {
+		return &n.flock
+	}
+	return &n.posix
+}
+
+func (l lockList) conflict(owner uint64, lk FileLock) (lockRange, bool) {
+	for _, r := range l {
+		if r.owner == owner || r.end < lk.Start || r.start > lk.End {
+			continue
+		}
+		if r.typ == syscall.F_WRLCK || lk.Type == syscall.F_WRLCK {
+			return r, true
+		}
+	}
+	return lockRange{}, false
+}
+
+// set replaces the owner's locks within lk's range. Adjacent and overlapping
+// ranges of the same type are merged, and ranges of a different type are split
+// around lk. A lock of type F_UNLCK only removes existing ranges.
+func (l lockList) set(lk lockRange) lockList {
+	out := l[:0:0]
+
+	for _, r := range l {
+		if r.owner != lk.owner {
+			out = append(out, r)
+			continue
+		}
+
+		if lk.typ == r.typ && touches(r, lk) {
+			if r.start < lk.start {
+				lk.start = r.start
+			}
+			if r.end > lk.end {
+				lk.end = r.end
+			}
+			continue
+		}
+
+		if r.end < lk.start || r.start > lk.end {
+			out = append(out, r)
+			continue
+		}
+
+		if r.start < lk.start {
+			left := r
+			left.end = lk.start - 1
+			out = append(out, left)
+		}
+		if r.end > lk.end {
+			right := r
+			right.start = lk.end + 1
+			out = append(out, right)
+		}
+	}
+
+	if lk.typ != syscall.F_UNLCK {
+		out = append(out, lk)
+	}
+	return out
+}
+
+// touches reports whether a and b overlap or are adjacent
+func touches(a, b lockRange) bool {
+	if a.start > b.start {
+		a, b = b, a
+	}
+	return a.end == math.MaxUint64 || a.end+1 >= b.start
+}
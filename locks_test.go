@@ -0,0 +1,125 @@
+package fuse
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func lkIn(owner, start, end uint64, typ uint32) *LkIn {
+	return &LkIn{
+		Owner: owner,
+		Lk:    FileLock{Start: start, End: end, Type: typ},
+	}
+}
+
+func TestLockListSet(t *testing.T) {
+	const (
+		rd = syscall.F_RDLCK
+		wr = syscall.F_WRLCK
+		un = syscall.F_UNLCK
+	)
+
+	tests := []struct {
+		name string
+		list lockList
+		set  lockRange
+		want lockList
+	}{
+		{
+			name: "merge adjacent",
+			list: lockList{{start: 0, end: 9, typ: rd, owner: 1}},
+			set:  lockRange{start: 10, end: 19, typ: rd, owner: 1},
+			want: lockList{{start: 0, end: 19, typ: rd, owner: 1}},
+		},
+		{
+			name: "split on type change",
+			list: lockList{{start: 0, end: 19, typ: rd, owner: 1}},
+			set:  lockRange{start: 5, end: 9, typ: wr, owner: 1},
+			want: lockList{
+				{start: 0, end: 4, typ: rd, owner: 1},
+				{start: 10, end: 19, typ: rd, owner: 1},
+				{start: 5, end: 9, typ: wr, owner: 1},
+			},
+		},
+		{
+			name: "unlock middle",
+			list: lockList{{start: 0, end: 19, typ: wr, owner: 1}},
+			set:  lockRange{start: 5, end: 9, typ: un, owner: 1},
+			want: lockList{
+				{start: 0, end: 4, typ: wr, owner: 1},
+				{start: 10, end: 19, typ: wr, owner: 1},
+			},
+		},
+		{
+			name: "other owners untouched",
+			list: lockList{{start: 0, end: 19, typ: rd, owner: 2}},
+			set:  lockRange{start: 5, end: 9, typ: un, owner: 1},
+			want: lockList{{start: 0, end: 19, typ: rd, owner: 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.list.set(tt.set); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLockManagerConflict(t *testing.T) {
+	var m LockManager
+	ctx := &Context{Header: &Header{}}
+	ctx.NodeID = 2
+
+	if err := m.Setlk(ctx, lkIn(1, 0, 99, syscall.F_RDLCK)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Setlk(ctx, lkIn(2, 50, 59, syscall.F_RDLCK)); err != nil {
+		t.Fatalf("shared locks should not conflict: %v", err)
+	}
+	if err := m.Setlk(ctx, lkIn(2, 90, 199, syscall.F_WRLCK)); err != EAGAIN {
+		t.Fatalf("expected EAGAIN, got %v", err)
+	}
+
+	out := LkOut{}
+	if err := m.Getlk(ctx, lkIn(3, 95, 95, syscall.F_WRLCK), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Lk.Type != syscall.F_RDLCK || out.Lk.Start != 0 || out.Lk.End != 99 {
+		t.Errorf("unexpected conflicting lock: %+v", out.Lk)
+	}
+
+	m.ReleaseOwner(ctx.NodeID, 1, false)
+	if err := m.Setlk(ctx, lkIn(2, 90, 199, syscall.F_WRLCK)); err != nil {
+		t.Fatalf("lock should be free after release: %v", err)
+	}
+}
+
+func TestLockManagerWait(t *testing.T) {
+	var m LockManager
+	ctx := &Context{Header: &Header{}}
+	ctx.NodeID = 2
+
+	if err := m.Setlk(ctx, lkIn(1, 0, 9, syscall.F_WRLCK)); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.Setlkw(ctx, lkIn(2, 0, 9, syscall.F_WRLCK))
+	}()
+
+	select {
+	case err := <-errc:
+		t.Fatalf("Setlkw returned early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := m.Setlk(ctx, lkIn(1, 0, 9, syscall.F_UNLCK)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
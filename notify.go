@@ -0,0 +1,260 @@
+package fuse
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"bytelog.org/fuse/proto"
+)
+
+// Notifications are unsolicited messages sent to the kernel, typically to
+// invalidate data it has cached. They are written directly to the device, and
+// are safe to call concurrently with request handling. Until the reply to INIT
+// has been sent, including while Filesystem.Init runs, they fail with
+// ErrServerClosed.
+//
+// A notification must not be sent from the execution path of a related
+// request, or while holding a lock needed to handle one. The kernel may hold
+// locks on the affected inodes until those requests complete, and the
+// notification would deadlock waiting on them.
+
+// minimum protocol versions for each notification
+const (
+	minorNotifyPoll   = 11
+	minorNotifyInval  = 12
+	minorNotifyStore  = 15
+	minorNotifyDelete = 18
+)
+
+// InvalidateInode invalidates the kernel's cached attributes of node, and its
+// cached data in the range [off, off+length). A negative off only invalidates
+// the attributes, and a length of 0 invalidates data to the end of the file.
+//
+// Returns ENOENT if the kernel has no cached inode for node, or ENOSYS if the
+// kernel does not support the notification.
+func (s *Server) InvalidateInode(node uint64, off, length int64) error {
+	sess, err := s.notifier(minorNotifyInval)
+	if err != nil {
+		return err
+	}
+	buf, out := notification(proto.NOTIFY_INVAL_INODE, unsafe.Sizeof(proto.NotifyInvalInodeOut{}), 0)
+	*(*proto.NotifyInvalInodeOut)(out) = proto.NotifyInvalInodeOut{
+		Ino: node,
+		Off: off,
+		Len: length,
+	}
+	return sess.notify(buf)
+}
+
+// InvalidateEntry invalidates the kernel's cached lookup of name in the
+// directory parent, along with the attributes of parent.
+//
+// Returns ENOENT if the kernel has no cached entry, or ENOSYS if the kernel
+// does not support the notification.
+func (s *Server) InvalidateEntry(parent uint64, name string) error {
+	sess, err := s.notifier(minorNotifyInval)
+	if err != nil {
+		return err
+	}
+	size := unsafe.Sizeof(proto.NotifyInvalEntryOut{})
+	buf, out := notification(proto.NOTIFY_INVAL_ENTRY, size, len(name)+1)
+	*(*proto.NotifyInvalEntryOut)(out) = proto.NotifyInvalEntryOut{
+		Parent:  parent,
+		Namelen: uint32(len(name)),
+	}
+	copy(buf[headerOutSize+size:], name)
+	return sess.notify(buf)
+}
+
+// NotifyDelete tells the kernel that name, referring to child, was removed
+// from the directory parent. Unlike InvalidateEntry, any cached entry for child
+// is also removed, as if the entry had been unlinked locally.
+//
+// Returns ENOENT if the kernel has no cached entry, or ENOSYS if the kernel
+// does not support the notification.
+func (s *Server) NotifyDelete(parent, child uint64, name string) error {
+	sess, err := s.notifier(minorNotifyDelete)
+	if err != nil {
+		return err
+	}
+	size := unsafe.Sizeof(proto.NotifyDeleteOut{})
+	buf, out := notification(proto.NOTIFY_DELETE, size, len(name)+1)
+	*(*proto.NotifyDeleteOut)(out) = proto.NotifyDeleteOut{
+		Parent:  parent,
+		Child:   child,
+		Namelen: uint32(len(name)),
+	}
+	copy(buf[headerOutSize+size:], name)
+	return sess.notify(buf)
+}
+
+// Store writes data into the kernel's page cache for node, starting at offset,
+// and extends the cached file size if needed. This may be used to make the
+// results of a prefetch available without a READ request.
+//
+// Returns ENOENT if the kernel has no cached inode for node, or ENOSYS if the
+// kernel does not support the notification.
+func (s *Server) Store(node, offset uint64, data []byte) error {
+	sess, err := s.notifier(minorNotifyStore)
+	if err != nil {
+		return err
+	}
+	size := unsafe.Sizeof(proto.NotifyStoreOut{})
+	buf, out := notification(proto.NOTIFY_STORE, size, len(data))
+	*(*proto.NotifyStoreOut)(out) = proto.NotifyStoreOut{
+		Nodeid: node,
+		Offset: offset,
+		Size:   uint32(len(data)),
+	}
+	copy(buf[headerOutSize+size:], data)
+	return sess.notify(buf)
+}
+
+// Retrieve reads up to size bytes of node's data from the kernel's page cache,
+// starting at offset. Fewer bytes are returned if the range extends past the
+// end of the file, or beyond the negotiated MaxWrite. Pages that are not
+// cached are returned as zeros.
+//
+// Returns ENOENT if the kernel has no cached inode for node, or ENOSYS if the
+// kernel does not support the notification.
+func (s *Server) Retrieve(ctx context.Context, node, offset uint64, size uint32) ([]byte, error) {
+	sess, err := s.notifier(minorNotifyStore)
+	if err != nil {
+		return nil, err
+	}
+
+	// the kernel replies with a NOTIFY_REPLY request, using our unique ID
+	reply := make(chan []byte, 1)
+	sess.reqMu.Lock()
+	sess.notifyUnique++
+	unique := sess.notifyUnique
+	sess.retrieves[unique] = reply
+	sess.reqMu.Unlock()
+
+	defer func() {
+		sess.reqMu.Lock()
+		delete(sess.retrieves, unique)
+		sess.reqMu.Unlock()
+	}()
+
+	buf, out := notification(proto.NOTIFY_RETRIEVE, unsafe.Sizeof(proto.NotifyRetrieveOut{}), 0)
+	*(*proto.NotifyRetrieveOut)(out) = proto.NotifyRetrieveOut{
+		NotifyUnique: unique,
+		Nodeid:       node,
+		Offset:       offset,
+		Size:         size,
+	}
+	if err := sess.notify(buf); err != nil {
+		return nil, err
+	}
+
+	select {
+	case data := <-reply:
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-sess.done:
+		return nil, ErrServerClosed
+	}
+}
+
+// PollHandle wakes the kernel's waiters for a file, after Poll has reported
+// that none of the requested events are ready.
+//
+// If Poll returns ENOSYS, as DefaultFilesystem does, the kernel stops sending
+// POLL requests and reports every file as always ready. The kernel also polls
+// a file as it's added to an epoll set, which os.File does on open. Requests
+// are still read while the runtime is blocked adding a file of the server's
+// own filesystem, unless GOMAXPROCS is 1.
+type PollHandle struct {
+	kh   uint64
+	sess *session
+}
+
+// Notify tells the kernel that the file may be ready, causing it to poll the
+// file again. Only the first call after each Poll has any effect.
+func (h *PollHandle) Notify() error {
+	select {
+	case <-h.sess.done:
+		return ErrServerClosed
+	default:
+	}
+	if h.sess.minor < minorNotifyPoll {
+		return ENOSYS
+	}
+	buf, out := notification(proto.NOTIFY_POLL, unsafe.Sizeof(proto.NotifyPollWakeupOut{}), 0)
+	*(*proto.NotifyPollWakeupOut)(out) = proto.NotifyPollWakeupOut{
+		Kh: h.kh,
+	}
+	return h.sess.notify(buf)
+}
+
+// notifier returns the session, if it's accepting notifications of the given
+// protocol version.
+func (s *Server) notifier(minor uint32) (*session, error) {
+	s.mu.Lock()
+	sess := s.session
+	s.mu.Unlock()
+
+	if sess == nil || atomic.LoadUint32(&sess.initialized) == 0 {
+		return nil, ErrServerClosed
+	}
+	select {
+	case <-sess.done:
+		return nil, ErrServerClosed
+	default:
+	}
+	if sess.minor < minor {
+		return nil, ENOSYS
+	}
+	return sess, nil
+}
+
+// notification allocates a message with an out struct of the given size,
+// followed by n bytes of data. The header is filled, and a pointer to the out
+// struct is returned.
+func notification(code proto.NotifyCode, size uintptr, n int) ([]byte, unsafe.Pointer) {
+	buf := make([]byte, int(headerOutSize+size)+n)
+	*(*proto.OutHeader)(unsafe.Pointer(&buf[0])) = proto.OutHeader{
+		Len:    uint32(len(buf)),
+		Error:  int32(code),
+		Unique: 0,
+	}
+	return buf, unsafe.Pointer(&buf[headerOutSize])
+}
+
+func (s *session) notify(buf []byte) error {
+	header := (*proto.OutHeader)(unsafe.Pointer(&buf[0]))
+	s.debugf("notify %s {Len:%d}", proto.NotifyCode(header.Error), header.Len)
+	if s.opts.WriteTimeout > 0 {
+		deadline := time.Now().Add(s.opts.WriteTimeout)
+		if err := s.dev.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	_, err := s.dev.Write(buf)
+	return err
+}
+
+// notifyReply delivers the data requested by Retrieve
+func (c *conn) notifyReply(ctx *Context) {
+	raw := (*proto.NotifyRetrieveIn)(ctx.in())
+	data := ctx.bytes(unsafe.Sizeof(*raw))
+	if uint32(len(data)) > raw.Size {
+		data = data[:raw.Size]
+	}
+
+	c.reqMu.Lock()
+	reply, ok := c.retrieves[ctx.ID]
+	delete(c.retrieves, ctx.ID)
+	c.reqMu.Unlock()
+
+	if !ok {
+		c.debugf("%s: retrieve %d was abandoned", ctx, ctx.ID)
+		return
+	}
+	// the request buffer is reused once we return
+	reply <- append([]byte(nil), data...)
+}
@@ -0,0 +1,130 @@
+package fuse
+
+import (
+	"os"
+	"testing"
+	"time"
+	"unsafe"
+
+	"bytelog.org/fuse/proto"
+)
+
+func TestNotification(t *testing.T) {
+	size := unsafe.Sizeof(proto.NotifyInvalEntryOut{})
+	buf, out := notification(proto.NOTIFY_INVAL_ENTRY, size, len("name")+1)
+
+	if len(buf) != 16+16+5 {
+		t.Fatalf("unexpected size %d", len(buf))
+	}
+	header := (*proto.OutHeader)(unsafe.Pointer(&buf[0]))
+	if header.Len != uint32(len(buf)) || header.Error != proto.NOTIFY_INVAL_ENTRY || header.Unique != 0 {
+		t.Errorf("unexpected header: %+v", *header)
+	}
+	if out != unsafe.Pointer(&buf[16]) {
+		t.Error("out struct should follow the header")
+	}
+}
+
+func TestNotifyReply(t *testing.T) {
+	reply := make(chan []byte, 1)
+	c := &conn{session: &session{
+		logger:    &logger{},
+		retrieves: map[uint64]chan []byte{7: reply},
+	}}
+
+	in := unsafe.Sizeof(proto.NotifyRetrieveIn{})
+	buf := make([]byte, headerInSize+in+8)
+	ctx := &Context{buf: buf, off: len(buf)}
+	ctx.Header = (*Header)(unsafe.Pointer(&buf[0]))
+	ctx.ID = 7
+	(*proto.NotifyRetrieveIn)(ctx.in()).Size = 5
+	copy(buf[headerInSize+in:], "hello...")
+
+	c.notifyReply(ctx)
+	if data := <-reply; string(data) != "hello" {
+		t.Errorf("unexpected data %q", data)
+	}
+	if len(c.retrieves) != 0 {
+		t.Error("retrieve should be removed once delivered")
+	}
+	c.notifyReply(ctx)
+}
+
+func TestPollHandle(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	sess := &session{logger: &logger{}, dev: w, done: make(chan struct{})}
+	h := &PollHandle{kh: 42, sess: sess}
+
+	sess.minor = minorNotifyPoll - 1
+	if err := h.Notify(); err != ENOSYS {
+		t.Errorf("expected ENOSYS, got %v", err)
+	}
+
+	sess.minor = minorNotifyPoll
+	if err := h.Notify(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := (*proto.OutHeader)(unsafe.Pointer(&buf[0]))
+	if n != 24 || header.Error != proto.NOTIFY_POLL {
+		t.Errorf("unexpected header: %+v", *header)
+	}
+	if kh := (*proto.NotifyPollWakeupOut)(unsafe.Pointer(&buf[16])).Kh; kh != 42 {
+		t.Errorf("unexpected kh %d", kh)
+	}
+
+	close(sess.done)
+	if err := h.Notify(); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestNotifyDuringInit(t *testing.T) {
+	srv := &Server{}
+	result := make(chan error, 1)
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		if ctx.Op == proto.INIT {
+			// a typical invalidation loop, started before INIT is complete
+			go func() {
+				for {
+					err := srv.InvalidateInode(1, 0, 0)
+					if err != ErrServerClosed {
+						result <- err
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+		return DefaultFilesystem(ctx, req, resp)
+	})
+	sess, kernel := newTestSession(t, fs, Options{})
+	defer kernel.Close()
+	defer sess.halt()
+	sess.ready, sess.minor = false, 0
+	srv.session = sess
+
+	send(t, kernel, proto.INIT, 1, &proto.InitIn{Major: 7, Minor: proto.KERNEL_MINOR_VERSION})
+	if err := sess.start(sess.dev); err != nil {
+		t.Fatal(err)
+	}
+	if h := recv(t, kernel); h.Unique != 1 || h.Error != 0 {
+		t.Fatalf("unexpected INIT reply: %+v", h)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if h := recv(t, kernel); h.Error != proto.NOTIFY_INVAL_INODE {
+		t.Errorf("unexpected notification: %+v", h)
+	}
+}
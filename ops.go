@@ -1,8 +1,10 @@
 package fuse
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"sync/atomic"
+	"unsafe"
 
 	"bytelog.org/fuse/proto"
 )
@@ -45,16 +47,17 @@ func (ctx *Context) handleInit(in *InitIn, out *InitOut) error {
 		in.Flags &^= proto.SPLICE_WRITE | proto.SPLICE_MOVE
 	}
 
+	opts := &ctx.sess.opts
 	*out = InitOut{
 		major:               proto.KERNEL_VERSION,
 		minor:               proto.KERNEL_MINOR_VERSION,
 		MaxReadahead:        in.MaxReadahead,
 		Flags:               in.Flags,
-		MaxBackground:       16,
-		CongestionThreshold: 12,
-		MaxWrite:            32 * uint32(os.Getpagesize()),
-		TimeGran:            1,
-		MaxPages:            32,
+		MaxBackground:       opts.MaxBackground,
+		CongestionThreshold: opts.CongestionThreshold,
+		MaxWrite:            opts.MaxWrite,
+		TimeGran:            opts.TimeGran,
+		MaxPages:            opts.MaxPages,
 	}
 
 	if out.Flags&proto.MAX_PAGES == 0 {
@@ -85,61 +88,187 @@ func (ctx *Context) handleInit(in *InitIn, out *InitOut) error {
 		return fmt.Errorf(format, EPROTO, out.MaxWrite, proto.BUFFER_HEADER_SIZE)
 	}
 
+	if max := uint32(opts.bufSize - proto.BUFFER_HEADER_SIZE); out.MaxWrite > max {
+		const format = "%w: MaxWrite (%d) cannot exceed %d"
+		return fmt.Errorf(format, EPROTO, out.MaxWrite, max)
+	}
+
 	if out.TimeGran < 1 || out.TimeGran > proto.MAX_TIME_GRAN {
 		const format = "%w: TimeGran (%d) must be between 1ns and 1s"
 		return fmt.Errorf(format, EPROTO, out.TimeGran)
 	}
 
-	if out.MaxPages > proto.MAX_MAX_PAGES {
+	if out.MaxPages > opts.MaxPages {
 		const format = "%w: MaxPages (%d) cannot exceed %d"
-		return fmt.Errorf(format, EPROTO, out.MaxPages, proto.MAX_MAX_PAGES)
+		return fmt.Errorf(format, EPROTO, out.MaxPages, opts.MaxPages)
 	}
 
 	// user data has been accepted, apply it to our session
 	ctx.sess.ready = true
 	ctx.sess.minor = in.Minor
-	ctx.sess.opts.maxReadahead = out.MaxReadahead
-	ctx.sess.opts.flags = out.Flags
-	ctx.sess.opts.maxWrite = out.MaxWrite
-	ctx.sess.opts.timeGran = out.TimeGran
-	ctx.sess.opts.maxPages = out.MaxPages
+	opts.maxReadahead = out.MaxReadahead
+	opts.flags = out.Flags
+	opts.maxWrite = out.MaxWrite
+	opts.timeGran = out.TimeGran
+	opts.maxPages = out.MaxPages
+	return nil
+}
+
+// Restricted ioctls have their input and output sizes determined from Cmd by
+// the kernel. Unrestricted ioctls, only issued by CUSE devices, start with no
+// data. The filesystem then replies with a retry, describing the regions of the
+// caller's memory to read and write, and the kernel repeats the request.
+func (ctx *Context) handleIoctl(raw *proto.IoctlIn) (uintptr, error) {
+	in := IoctlIn{
+		Fh:      raw.Fh,
+		Flags:   IoctlFlags(raw.Flags),
+		Cmd:     raw.Cmd,
+		Arg:     raw.Arg,
+		OutSize: raw.OutSize,
+	}
+	data := ctx.bytes(unsafe.Sizeof(*raw))
+	if uint32(len(data)) < raw.InSize {
+		const format = "%w: ioctl size (%d) exceeds payload (%d)"
+		return 0, fmt.Errorf(format, EPROTO, raw.InSize, len(data))
+	}
+	in.Data = data[:raw.InSize]
+
+	out := IoctlOut{}
+	if err := ctx.sess.fs.Ioctl(ctx, &in, &out); err != nil {
+		return 0, err
+	}
+
+	size := unsafe.Sizeof(proto.IoctlOut{})
+	header := (*proto.IoctlOut)(ctx.outzero(size))
+	buf := ctx.outData()[size:]
+
+	if !out.retry {
+		if uint32(len(buf)) > in.OutSize {
+			buf = buf[:in.OutSize]
+		}
+		if len(out.Data) > len(buf) {
+			const format = "%w: ioctl data (%d) exceeds out size (%d)"
+			return 0, fmt.Errorf(format, EPROTO, len(out.Data), len(buf))
+		}
+		header.Result = out.Result
+		return size + uintptr(copy(buf, out.Data)), nil
+	}
+
+	n := len(out.inIovs) + len(out.outIovs)
+	switch {
+	case !in.Flags.Unrestricted():
+		return 0, fmt.Errorf("%w: cannot retry a restricted ioctl", EPROTO)
+	case n > proto.IOCTL_MAX_IOV:
+		const format = "%w: ioctl retry iovecs (%d) exceeds %d"
+		return 0, fmt.Errorf(format, EPROTO, n, proto.IOCTL_MAX_IOV)
+	}
+	header.Flags = proto.IOCTL_RETRY
+	header.InIovs = uint32(len(out.inIovs))
+	header.OutIovs = uint32(len(out.outIovs))
+	for _, iovs := range [][]IoctlIovec{out.inIovs, out.outIovs} {
+		for _, iov := range iovs {
+			*(*IoctlIovec)(unsafe.Pointer(&buf[0])) = iov
+			buf = buf[unsafe.Sizeof(iov):]
+			size += unsafe.Sizeof(iov)
+		}
+	}
+	return size, nil
+}
+
+// READDIRPLUS is negotiated regardless of the filesystem, so it's served
+// through Readdir once Readdirplus is rejected. The entries are then sent
+// without lookup results, which the kernel accepts in place of a lookup.
+func (ctx *Context) handleReaddirplus(in *ReaddirplusIn, out *ReaddirplusOut) error {
+	s := ctx.sess
+	if atomic.LoadUint32(&s.noReaddirplus) == 0 {
+		err := s.fs.Readdirplus(ctx, in, out)
+		if !errors.Is(err, ENOSYS) {
+			return err
+		}
+		s.debugf("READDIRPLUS not implemented, falling back to READDIR")
+		atomic.StoreUint32(&s.noReaddirplus, 1)
+		out.n = 0
+	}
+
+	// handlers dispatching on the opcode must see a READDIR
+	ctx.Op = proto.READDIR
+	dirents := ReaddirOut{buf: make([]byte, len(out.buf))}
+	err := s.fs.Readdir(ctx, (*ReaddirIn)(in), &dirents)
+	ctx.Op = proto.READDIRPLUS
+	if err != nil {
+		return err
+	}
+	for off := 0; off < dirents.n; {
+		ent := (*proto.Dirent)(unsafe.Pointer(&dirents.buf[off]))
+		name := dirents.buf[off+int(proto.NAME_OFFSET):]
+		name = name[:ent.Namelen]
+		off += int(proto.DirentAlign(proto.DirentSize(*ent)))
+
+		dirent := Dirent{
+			Ino:  ent.Ino,
+			Off:  ent.Off,
+			Mode: ent.Type << 12,
+			Name: string(name),
+		}
+		if !out.Add(dirent, EntryOut{}) {
+			break
+		}
+	}
 	return nil
 }
 
-/*
-func handleOpendir(ctx *Context) {
-	out := (*proto.OpenOut)(ctx.outData())
-	*out = proto.OpenOut{}
-
-	ctx.replySize = uint32(unsafe.Sizeof(proto.OpenOut{}))
-	ctx.sess.handler.Opendir(
-		&OpendirRequest{
-			Request: ctx.request(),
-			OpenIn:  (*proto.OpenIn)(ctx.data()),
-		},
-		&OpendirResponse{
-			response: ctx.response(),
-			OpenOut:  out,
-		},
-	)
+// Both GETXATTR and LISTXATTR replies follow the same protocol. A request size
+// of zero probes for the size of the value. Otherwise, the value is returned
+// directly, or ERANGE if it doesn't fit in the requested size.
+func (ctx *Context) handleGetxattr(raw *proto.GetxattrIn) (uintptr, error) {
+	in := GetxattrIn{Name: ctx.string(unsafe.Sizeof(*raw))}
+	out := GetxattrOut{}
+	if err := ctx.sess.fs.Getxattr(ctx, &in, &out); err != nil {
+		return 0, err
+	}
+
+	buf, size, err := ctx.xattrBuf(raw.Size, len(out.Value))
+	if buf != nil {
+		copy(buf, out.Value)
+	}
+	return size, err
+}
+
+func (ctx *Context) handleListxattr(raw *proto.GetxattrIn) (uintptr, error) {
+	out := ListxattrOut{}
+	if err := ctx.sess.fs.Listxattr(ctx, &out); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, name := range out.Names {
+		n += len(name) + 1
+	}
+
+	buf, size, err := ctx.xattrBuf(raw.Size, n)
+	for _, name := range out.Names {
+		if buf == nil {
+			break
+		}
+		buf[copy(buf, name)] = 0
+		buf = buf[len(name)+1:]
+	}
+	return size, err
 }
-*/
-
-/*
-// Intended Behavior from fuse(4): "The requested action is to read up to
-//   size bytes of the file or directory, starting at offset. The bytes
-//   should be returned directly following the usual reply header."
-func handleReaddir(ctx *Context) {
-
-	// todo: this doesn't actually output anything yet. add output handling.
-	ctx.sess.handler.Readdir(
-		&ReaddirRequest{
-			Request: ctx.request(),
-			ReadIn:  (*proto.ReadIn)(ctx.data()),
-		},
-		&ReaddirResponse{
-			response: ctx.response(),
-		},
-	)
+
+// xattrBuf returns the reply buffer for an xattr value of n bytes. The buffer
+// is nil if only the size has been requested.
+func (ctx *Context) xattrBuf(max uint32, n int) ([]byte, uintptr, error) {
+	if max == 0 {
+		size := unsafe.Sizeof(proto.GetxattrOut{})
+		out := (*proto.GetxattrOut)(ctx.outzero(size))
+		out.Size = uint32(n)
+		return nil, size, nil
+	}
+
+	buf := ctx.outLimit(max)
+	if n > len(buf) {
+		return nil, 0, ERANGE
+	}
+	return buf[:n], uintptr(n), nil
 }
-*/
@@ -0,0 +1,189 @@
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"bytelog.org/fuse/proto"
+)
+
+func TestHandleIoctl(t *testing.T) {
+	ioctl := func(flags uint32, input string, fs HandlerFunc) (*Context, uintptr, error) {
+		in := unsafe.Sizeof(proto.IoctlIn{})
+		buf := make([]byte, 8192)
+		ctx := &Context{buf: buf, off: int(headerInSize+in) + len(input)}
+		ctx.Header = (*Header)(unsafe.Pointer(&buf[0]))
+		ctx.sess = &session{fs: fs}
+		*(*proto.IoctlIn)(ctx.in()) = proto.IoctlIn{
+			Flags:   flags,
+			Cmd:     0x1234,
+			InSize:  uint32(len(input)),
+			OutSize: 8,
+		}
+		copy(buf[headerInSize+in:], input)
+
+		size, err := ctx.handleIoctl((*proto.IoctlIn)(ctx.in()))
+		return ctx, size, err
+	}
+	header := func(ctx *Context) *proto.IoctlOut {
+		return (*proto.IoctlOut)(ctx.out())
+	}
+
+	ctx, size, err := ioctl(0, "ping", func(ctx *Context, req Request, resp Response) error {
+		if in := req.(*IoctlIn); in.Cmd != 0x1234 || string(in.Data) != "ping" {
+			t.Errorf("unexpected request: %+v", *in)
+		}
+		*resp.(*IoctlOut) = IoctlOut{Result: 3, Data: []byte("pong")}
+		return nil
+	})
+	if err != nil || size != 16+4 || header(ctx).Result != 3 {
+		t.Fatalf("unexpected reply: %d %v %+v", size, err, *header(ctx))
+	}
+	if data := string(ctx.outData()[16:20]); data != "pong" {
+		t.Errorf("unexpected data %q", data)
+	}
+
+	_, _, err = ioctl(0, "", func(ctx *Context, req Request, resp Response) error {
+		resp.(*IoctlOut).Data = []byte("too much data")
+		return nil
+	})
+	if !errors.Is(err, EPROTO) {
+		t.Errorf("expected EPROTO for oversized data, got %v", err)
+	}
+
+	retry := func(ctx *Context, req Request, resp Response) error {
+		resp.(*IoctlOut).Retry(
+			[]IoctlIovec{{Base: 0x1000, Len: 4}},
+			[]IoctlIovec{{Base: 0x2000, Len: 8}, {Base: 0x3000, Len: 2}},
+		)
+		return nil
+	}
+	if _, _, err = ioctl(0, "", retry); !errors.Is(err, EPROTO) {
+		t.Errorf("expected EPROTO for restricted retry, got %v", err)
+	}
+
+	ctx, size, err = ioctl(proto.IOCTL_UNRESTRICTED, "", retry)
+	if err != nil || size != 16+3*16 {
+		t.Fatalf("unexpected reply: %d %v", size, err)
+	}
+	if h := header(ctx); h.Flags != proto.IOCTL_RETRY || h.InIovs != 1 || h.OutIovs != 2 {
+		t.Errorf("unexpected header: %+v", *h)
+	}
+	iovs := (*[3]IoctlIovec)(unsafe.Pointer(&ctx.outData()[16]))
+	if iovs[0].Base != 0x1000 || iovs[1].Base != 0x2000 || iovs[2].Len != 2 {
+		t.Errorf("unexpected iovecs: %+v", *iovs)
+	}
+}
+
+func TestHandleXattr(t *testing.T) {
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		switch ctx.Op {
+		case proto.GETXATTR:
+			if name := req.(*GetxattrIn).Name; name != "user.a" {
+				t.Errorf("unexpected name %q", name)
+			}
+			resp.(*GetxattrOut).Value = []byte("value")
+		case proto.LISTXATTR:
+			resp.(*ListxattrOut).Names = []string{"user.a", "user.bb"}
+		}
+		return nil
+	})
+
+	tests := []struct {
+		op   proto.OpCode
+		size uint32
+		want string
+		err  error
+	}{
+		{proto.GETXATTR, 0, "\x05\x00\x00\x00\x00\x00\x00\x00", nil},
+		{proto.GETXATTR, 16, "value", nil},
+		{proto.GETXATTR, 5, "value", nil},
+		{proto.GETXATTR, 4, "", ERANGE},
+		{proto.LISTXATTR, 0, "\x0f\x00\x00\x00\x00\x00\x00\x00", nil},
+		{proto.LISTXATTR, 15, "user.a\x00user.bb\x00", nil},
+		{proto.LISTXATTR, 14, "", ERANGE},
+	}
+	for _, tt := range tests {
+		in := unsafe.Sizeof(proto.GetxattrIn{})
+		name := "user.a\x00"
+		buf := make([]byte, 8192)
+		ctx := &Context{buf: buf, off: int(headerInSize+in) + len(name)}
+		ctx.Header = (*Header)(unsafe.Pointer(&buf[0]))
+		ctx.Op = tt.op
+		ctx.sess = &session{fs: fs}
+		raw := (*proto.GetxattrIn)(ctx.in())
+		raw.Size = tt.size
+		copy(buf[headerInSize+in:], name)
+
+		var size uintptr
+		var err error
+		if tt.op == proto.GETXATTR {
+			size, err = ctx.handleGetxattr(raw)
+		} else {
+			size, err = ctx.handleListxattr(raw)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v %d: expected %v, got %v", tt.op, tt.size, tt.err, err)
+			continue
+		}
+		if got := string(ctx.outData()[:size]); got != tt.want {
+			t.Errorf("%v %d: expected %q, got %q", tt.op, tt.size, tt.want, got)
+		}
+	}
+}
+
+func TestHandleReaddirplus(t *testing.T) {
+	readdir := 0
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		if ctx.Op != proto.READDIR {
+			return DefaultFilesystem(ctx, req, resp)
+		}
+		readdir++
+		out := resp.(*ReaddirOut)
+		out.Add(Dirent{Ino: 1, Off: 1, Mode: syscall.S_IFDIR, Name: "."})
+		out.Add(Dirent{Ino: 1, Off: 2, Mode: syscall.S_IFDIR, Name: ".."})
+		out.Add(Dirent{Ino: 5, Off: 3, Mode: syscall.S_IFREG | 0644, Name: "file"})
+		return nil
+	})
+	sess := &session{fs: fs, logger: &logger{}}
+	readdirplus := func() (*Context, ReaddirplusOut, error) {
+		in := unsafe.Sizeof(ReaddirplusIn{})
+		buf := make([]byte, 8192)
+		ctx := &Context{buf: buf, off: int(headerInSize + in)}
+		ctx.Header = (*Header)(unsafe.Pointer(&buf[0]))
+		ctx.Op = proto.READDIRPLUS
+		ctx.sess = sess
+		out := ReaddirplusOut{buf: ctx.outLimit(4096)}
+		err := ctx.handleReaddirplus(&ReaddirplusIn{Size: 4096}, &out)
+		return ctx, out, err
+	}
+
+	// listed through Readdir once Readdirplus is rejected, and from then on
+	for i := 1; i <= 2; i++ {
+		ctx, out, err := readdirplus()
+		if err != nil || readdir != i || ctx.Op != proto.READDIRPLUS {
+			t.Fatalf("unexpected result: %v %d %v", err, readdir, ctx.Op)
+		}
+
+		var names []string
+		for off := 0; off < out.n; {
+			ent := (*proto.Direntplus)(unsafe.Pointer(&out.buf[off]))
+			name := out.buf[off+int(proto.NAME_OFFSET_DIRENTPLUS):]
+			names = append(names, string(name[:ent.Dirent.Namelen]))
+			off += int(proto.DirentAlign(proto.DirentplusSize(*ent)))
+
+			if ent.EntryOut.Nodeid != 0 {
+				t.Errorf("unexpected lookup result: %+v", ent.EntryOut)
+			}
+			if name := names[len(names)-1]; name == "file" && ent.Dirent.Type != syscall.DT_REG {
+				t.Errorf("unexpected type: %d", ent.Dirent.Type)
+			}
+		}
+		if fmt.Sprint(names) != "[. .. file]" {
+			t.Errorf("unexpected entries: %v", names)
+		}
+	}
+}
@@ -892,7 +892,7 @@ type Direntplus struct {
 	Dirent   Dirent
 }
 
-const NAME_OFFSET_DIRENTPLUS = uint32(unsafe.Offsetof(Direntplus{}.Dirent.Name))
+const NAME_OFFSET_DIRENTPLUS = uint32(unsafe.Offsetof(Direntplus{}.Dirent)) + NAME_OFFSET
 
 func DirentplusSize(ent Direntplus) uint32 {
 	return NAME_OFFSET_DIRENTPLUS + ent.Dirent.Namelen
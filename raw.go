@@ -8,40 +8,74 @@ import (
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
 	"bytelog.org/fuse/proto"
+	"golang.org/x/sys/unix"
 )
 
 var (
 	ErrBadInit       = errors.New("fuse: protocol negotiation failed")
 	ErrUnsupportedOp = errors.New("fuse: unsupported op")
+
+	// reasons a session may end, other than Shutdown
+	ErrUnmounted = errors.New("fuse: filesystem unmounted")
+	ErrDestroyed = errors.New("fuse: filesystem destroyed")
+	ErrAborted   = errors.New("fuse: connection aborted")
 )
 
 const (
 	headerInSize  = unsafe.Sizeof(proto.InHeader{})
 	headerOutSize = unsafe.Sizeof(proto.OutHeader{})
+
+	// default number of pages allowed in a single request
+	defaultMaxPages = 32
 )
 
-// experimental option ideas
 type opts struct {
 	// control whether or not file descriptor cloning is enabled
 	// defaults to true
 	CloneFD bool
 
-	// how many polling threads to allow
+	// maximum number of requests handled concurrently
 	MaxWorkers int
 
+	// bounds for the number of connections reading from the device. Readers
+	// beyond the minimum are started when all others are busy, and reclaimed
+	// after ReadTimeout.
+	MinReaders int
+	MaxReaders int
+
 	// fuse timeout. sets how long to wait for kernel reads.
 	// after a timeout, a cloned descriptor is considered idle and may be
 	// reclaimed
 	ReadTimeout time.Duration
 
-	// how long a Context has to respond
+	// how long a reply may take to be written to the device
 	WriteTimeout time.Duration
 
+	// how long a Context has to respond. Zero sets no deadline.
+	RequestTimeout time.Duration
+
+	// values proposed to the kernel during INIT
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	MaxPages            uint16
+	TimeGran            uint32
+
+	// reject requests from users other than the owner and root
+	denyOthers bool
+	owner      uint32
+
+	// request buffers must be large enough to hold MaxWrite bytes of data, or
+	// a reply of MaxPages pages, plus space for the request and reply headers.
+	bufSize int
+
+	// values negotiated during INIT
 	maxReadahead uint32
 	flags        uint32
 	maxWrite     uint32
@@ -50,9 +84,103 @@ type opts struct {
 }
 
 var defaultOpts = opts{
-	CloneFD:      true,
-	ReadTimeout:  15 * time.Second,
-	WriteTimeout: time.Second,
+	CloneFD:       true,
+	MaxWorkers:    32,
+	MinReaders:    1,
+	MaxReaders:    4,
+	ReadTimeout:   15 * time.Second,
+	WriteTimeout:  time.Second,
+	MaxBackground: 16,
+	MaxPages:      defaultMaxPages,
+	TimeGran:      1,
+}
+
+// newOpts applies the user's options over the defaults, and validates them.
+func newOpts(o *Options) (opts, error) {
+	v := defaultOpts
+	v.CloneFD = !o.DisableCloneFD
+	v.denyOthers = o.AllowRoot
+	v.owner = uint32(os.Getuid())
+
+	if o.MaxWorkers < 0 {
+		const format = "%w: MaxWorkers (%d) cannot be negative"
+		return v, fmt.Errorf(format, ErrInvalidOption, o.MaxWorkers)
+	} else if o.MaxWorkers > 0 {
+		v.MaxWorkers = o.MaxWorkers
+	}
+
+	if o.MinReaders < 0 || o.MaxReaders < 0 {
+		const format = "%w: MinReaders (%d) and MaxReaders (%d) cannot be negative"
+		return v, fmt.Errorf(format, ErrInvalidOption, o.MinReaders, o.MaxReaders)
+	}
+	if o.MinReaders > 0 {
+		v.MinReaders = o.MinReaders
+	}
+	if o.MaxReaders > 0 {
+		v.MaxReaders = o.MaxReaders
+	} else if v.MaxReaders < v.MinReaders {
+		v.MaxReaders = v.MinReaders
+	}
+	if v.MinReaders > v.MaxReaders {
+		const format = "%w: MinReaders (%d) cannot exceed MaxReaders (%d)"
+		return v, fmt.Errorf(format, ErrInvalidOption, v.MinReaders, v.MaxReaders)
+	}
+
+	if o.ReadTimeout != 0 {
+		v.ReadTimeout = o.ReadTimeout
+	}
+	if o.WriteTimeout != 0 {
+		v.WriteTimeout = o.WriteTimeout
+	}
+	if o.RequestTimeout > 0 {
+		v.RequestTimeout = o.RequestTimeout
+	}
+
+	if o.MaxPages > proto.MAX_MAX_PAGES {
+		const format = "%w: MaxPages (%d) cannot exceed %d"
+		return v, fmt.Errorf(format, ErrInvalidOption, o.MaxPages, proto.MAX_MAX_PAGES)
+	} else if o.MaxPages > 0 {
+		v.MaxPages = o.MaxPages
+	}
+
+	max := uint32(v.MaxPages) * uint32(os.Getpagesize())
+	v.MaxWrite = max
+	if o.MaxWrite > 0 {
+		if o.MaxWrite < proto.BUFFER_HEADER_SIZE || o.MaxWrite > max {
+			const format = "%w: MaxWrite (%d) must be between %d and %d"
+			return v, fmt.Errorf(format, ErrInvalidOption, o.MaxWrite, proto.BUFFER_HEADER_SIZE, max)
+		}
+		v.MaxWrite = o.MaxWrite
+	}
+	v.bufSize = proto.BUFFER_HEADER_SIZE + int(max)
+
+	if o.MaxBackground > 0 {
+		v.MaxBackground = o.MaxBackground
+	}
+	v.CongestionThreshold = v.MaxBackground * 3 / 4
+	if o.CongestionThreshold > 0 {
+		if o.CongestionThreshold > v.MaxBackground {
+			const format = "%w: CongestionThreshold (%d) cannot exceed MaxBackground (%d)"
+			return v, fmt.Errorf(format, ErrInvalidOption, o.CongestionThreshold, v.MaxBackground)
+		}
+		v.CongestionThreshold = o.CongestionThreshold
+	}
+
+	if o.TimeGran < 0 || o.TimeGran > proto.MAX_TIME_GRAN {
+		const format = "%w: TimeGran (%s) must be between 1ns and 1s"
+		return v, fmt.Errorf(format, ErrInvalidOption, o.TimeGran)
+	} else if o.TimeGran > 0 {
+		g := o.TimeGran
+		for g%10 == 0 {
+			g /= 10
+		}
+		if g != 1 {
+			const format = "%w: TimeGran (%s) must be a power of 10"
+			return v, fmt.Errorf(format, ErrInvalidOption, o.TimeGran)
+		}
+		v.TimeGran = uint32(o.TimeGran)
+	}
+	return v, nil
 }
 
 type session struct {
@@ -60,24 +188,93 @@ type session struct {
 
 	fs   Filesystem
 	opts opts
-	errc chan error
+
+	// errors encountered by connections
+	errMu sync.Mutex
+	errs  []error
+
+	// forcefully aborts the connection with the kernel, if possible
+	abort func() error
+
+	// called once the session has ended, with the reason
+	ended      func(error)
+	reason     error
+	haltOnce   sync.Once
+	finishOnce sync.Once
+
+	// held by readers while adding handlers, so that none are added once
+	// the session has been halted
+	haltMu sync.RWMutex
 
 	dev   *os.File
 	minor uint32
-	sem   semaphore
 	ready bool
 
+	// write end of a pipe, closed by halt to wake the direct reader
+	wakeDirect *os.File
+
+	// set once INIT has been replied to. Notifications may be sent from any
+	// goroutine, and must observe it before reading minor.
+	initialized uint32
+
+	// set once the filesystem has rejected CREATE
+	noCreate uint32
+
+	// set once the filesystem has rejected READDIRPLUS
+	noReaddirplus uint32
+
+	// locks held on behalf of DefaultFilesystem
+	locks LockManager
+
+	// in-flight requests, and interrupts that arrived without a matching
+	// request, both indexed by the target request's unique ID
+	reqMu      sync.Mutex
+	requests   map[uint64]*Context
+	interrupts map[uint64]uint64
+
+	// replies to Retrieve, indexed by the unique ID of the notification
+	retrieves    map[uint64]chan []byte
+	notifyUnique uint64
+
+	// tokens for handler goroutines, and a count of the running handlers
+	workers chan struct{}
+	wg      sync.WaitGroup
+
+	// running poll loops
+	pollers sync.WaitGroup
+
+	// number of connections, and how many of those are waiting for requests
+	readers int32
+	idle    int32
+
 	connsMu sync.Mutex
 	conns   *list.List
 
+	// request contexts, each with a buffer of opts.bufSize bytes
+	pool sync.Pool
+
 	starved chan struct{}
 	done    chan struct{}
 }
 
-func (s *session) start(dev *os.File) error {
+func (s *session) start(dev *os.File) (err error) {
+	s.dev = dev
+	s.conns = list.New()
+	s.workers = make(chan struct{}, s.opts.MaxWorkers)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer closeOnErr(r, &err)
+	defer closeOnErr(w, &err)
+	s.wakeDirect = w
+
+	// the original device is read directly, see conn.read
 	c := &conn{
 		session: s,
 		dev:     dev,
+		direct:  r,
 	}
 
 	// allow up to three attempts for protocol negotiation
@@ -91,69 +288,225 @@ func (s *session) start(dev *os.File) error {
 		return ErrBadInit
 	}
 	s.debugf("FUSE 7.%d accepted", s.minor)
-	go s.control(dev)
+	atomic.StoreUint32(&s.initialized, 1)
+
+	// the original device is never reclaimed
+	s.serve(c)
+	for i := 1; i < s.opts.MinReaders; i++ {
+		s.spawn()
+	}
+	go s.control()
 	return nil
 }
 
-func (s *session) control(dev *os.File) {
-	const (
-		min = 1
-		max = 1
-	)
+// control starts additional connections as existing ones become busy
+func (s *session) control() {
+	for {
+		select {
+		case <-s.starved:
+		case <-s.done:
+			return
+		}
+		if int(atomic.LoadInt32(&s.readers)) < s.opts.MaxReaders {
+			s.debugf("connections starved, starting reader")
+			s.spawn()
+		}
+	}
+}
 
-	count := 0
+// spawn a new connection, cloning the device if enabled
+func (s *session) spawn() {
+	dev := s.dev
+	if s.opts.CloneFD {
+		f, err := clone(s.dev)
+		if err != nil {
+			s.logf("failed to clone device: %v", err)
+			return
+		}
+		dev = f
+	}
+	s.serve(&conn{
+		session: s,
+		dev:     dev,
+	})
+}
 
-	for {
-		if count < max {
-			s.debugf("connections starved, cloning")
+func (s *session) serve(c *conn) {
+	atomic.AddInt32(&s.readers, 1)
+	s.pollers.Add(1)
+	s.connsMu.Lock()
+	c.elem = s.conns.PushBack(c)
+	s.connsMu.Unlock()
+	go c.poll()
+}
+
+// close stops accepting requests, and waits for in-flight requests to complete.
+// If ctx expires first, requests are cancelled and the connection is aborted,
+// though handlers must still return before the filesystem is destroyed.
+// Returns the errors encountered by the session's connections.
+func (s *session) close(ctx context.Context) error {
+	s.halt()
+	s.wake()
 
-			s.sem.release(1)
-			count++
+	drained := make(chan struct{})
+	go func() {
+		s.pollers.Wait()
+		s.wg.Wait()
+		close(drained)
+	}()
 
-			// clone and start connection
-			f, err := clone(dev)
-			if err != nil {
-				panic(err)
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.debugf("shutdown: %v, aborting requests", ctx.Err())
+		s.cancelRequests()
+		if s.abort != nil {
+			if err := s.abort(); err != nil {
+				s.fail(fmt.Errorf("failed to abort connection: %w", err))
 			}
+		}
+		s.fail(ctx.Err())
 
-			c := &conn{
-				session: s,
-				dev:     f,
+		// the filesystem must not be destroyed while handlers are running
+		<-drained
+	}
+
+	if err := s.finish(nil, ErrServerClosed); err != nil {
+		s.fail(err)
+	}
+	if err := s.dev.Close(); err != nil {
+		s.fail(err)
+	}
+
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return errorList(s.errs...)
+}
+
+// halt stops accepting requests. Once it returns, no further handlers are
+// started, so that the session may wait for those already running.
+func (s *session) halt() {
+	s.haltMu.Lock()
+	defer s.haltMu.Unlock()
+
+	s.haltOnce.Do(func() {
+		close(s.done)
+		if s.wakeDirect != nil {
+			if err := s.wakeDirect.Close(); err != nil {
+				s.fail(err)
 			}
-			go c.poll()
-			// todo: add to connection list
 		}
+	})
+}
 
-		select {
-		case <-s.starved:
-		case <-s.done:
-			return
+// wake readers blocked on the device, once the session has been halted. done
+// is closed first, so that a reader can't extend its deadline afterwards
+// without observing it.
+func (s *session) wake() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for e := s.conns.Front(); e != nil; e = e.Next() {
+		if err := e.Value.(*conn).dev.SetReadDeadline(time.Now()); err != nil {
+			s.fail(err)
 		}
 	}
 }
 
-func (s *session) close(ctx context.Context) error {
-	close(s.done)
-	// - close(done)
-	// - if ctx has expired, close connection's file from under it
-	// - close device
-	return s.dev.Close()
+// terminate ends the session once the connection with the kernel is lost. It
+// must not be called from a poll loop, since it waits for them to return.
+func (s *session) terminate(reason error) {
+	s.halt()
+	s.wake()
+	s.pollers.Wait()
+	s.wg.Wait()
+	if err := s.finish(nil, reason); err != nil {
+		s.logf("destroy: %v", err)
+	}
+}
+
+// finish destroys the filesystem and reports the reason the session ended. Only
+// the first call has any effect. If ctx is nil, a Context is provided for
+// Destroy.
+func (s *session) finish(ctx *Context, reason error) (err error) {
+	s.finishOnce.Do(func() {
+		if s.ready {
+			if ctx == nil {
+				ctx = s.acquireCtx()
+				defer s.releaseCtx(ctx)
+				*ctx.Header = Header{Op: proto.DESTROY}
+			}
+			ctx.reset(time.Time{})
+			err = s.fs.Destroy(ctx)
+		}
+		s.reason = reason
+		s.debugf("session ended: %v", reason)
+		if s.ended != nil {
+			s.ended(reason)
+		}
+	})
+	return err
+}
+
+// fail records an error encountered by the session
+func (s *session) fail(err error) {
+	s.errMu.Lock()
+	s.errs = append(s.errs, err)
+	s.errMu.Unlock()
 }
 
 type conn struct {
 	*session
-	dev *os.File
+	dev  *os.File
+	elem *list.Element
+
+	// requests being handled, which must reply on dev before it's closed
+	pending sync.WaitGroup
+
+	// set if the connection has already been removed from the reader count
+	reclaimed bool
+
+	// if set, requests are read directly, and the read end of the session's
+	// wake pipe is closed once the connection stops
+	direct *os.File
 }
 
 // poll is a read loop. it waits for requests from the kernel and performs some
 // basic sanity checks before sending off to a handler. It is expected that the
 // session closes the connection's reader to terminate poll gracefully.
 func (c *conn) poll() {
+	defer c.stop()
+
 	for {
-		if err := c.accept(); err != nil {
-			// todo: on deadline error, determine whether or not to
-			// close connection
-			c.logf("accept error: %v", err)
+		err := c.accept()
+		switch {
+		case err == nil:
+		case os.IsTimeout(err):
+			if c.reclaim() {
+				c.debugf("reclaimed idle connection")
+				return
+			}
+		case errors.Is(err, syscall.ENOENT), errors.Is(err, syscall.EINTR):
+			// request was interrupted before it could be read
+		default:
+			select {
+			case <-c.done:
+				// the device was closed or aborted by shutdown
+			default:
+				switch {
+				case errors.Is(err, syscall.ENODEV):
+					go c.terminate(ErrUnmounted)
+				case errors.Is(err, syscall.ECONNABORTED):
+					go c.terminate(ErrAborted)
+				case c.dev == c.session.dev:
+					c.logf("accept error: %v", err)
+					c.fail(err)
+					go c.terminate(err)
+				default:
+					c.logf("accept error: %v", err)
+					c.fail(err)
+				}
+			}
 			return
 		}
 		select {
@@ -164,11 +517,47 @@ func (c *conn) poll() {
 	}
 }
 
-var ctxPool sync.Pool
+// reclaim reports whether an idle connection may be closed
+func (c *conn) reclaim() bool {
+	if c.dev == c.session.dev {
+		return false
+	}
+	for {
+		n := atomic.LoadInt32(&c.readers)
+		if int(n) <= c.opts.MinReaders {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&c.readers, n, n-1) {
+			c.reclaimed = true
+			return true
+		}
+	}
+}
+
+func (c *conn) stop() {
+	defer c.pollers.Done()
 
-func (c *conn) accept() (err error) {
-	defer closeOnErr(c.dev, &err)
+	c.connsMu.Lock()
+	c.conns.Remove(c.elem)
+	c.connsMu.Unlock()
 
+	if !c.reclaimed {
+		atomic.AddInt32(&c.readers, -1)
+	}
+	if c.direct != nil {
+		if err := c.direct.Close(); err != nil {
+			c.fail(err)
+		}
+	}
+	if c.dev != c.session.dev {
+		c.pending.Wait()
+		if err := c.dev.Close(); err != nil {
+			c.fail(err)
+		}
+	}
+}
+
+func (c *conn) accept() error {
 	if c.opts.ReadTimeout > 0 {
 		deadline := time.Now().Add(c.opts.ReadTimeout)
 		if err := c.dev.SetReadDeadline(deadline); err != nil {
@@ -176,17 +565,30 @@ func (c *conn) accept() (err error) {
 		}
 	}
 
-	if !c.sem.tryAcquire(1) {
-		c.starved <- struct{}{}
+	// the deadline must not replace one set by close
+	select {
+	case <-c.done:
+		return ErrServerClosed
+	default:
 	}
 
 	ctx := c.acquireCtx()
-	n, err := c.dev.Read(ctx.buf)
+	atomic.AddInt32(&c.idle, 1)
+	n, err := c.read(ctx.buf)
+	if atomic.AddInt32(&c.idle, -1) == 0 && err == nil {
+		select {
+		case c.starved <- struct{}{}:
+		default:
+		}
+	}
+
 	if err != nil {
+		c.releaseCtx(ctx)
 		return fmt.Errorf("failed read from fuse device: %w", err)
 	}
 
 	if n < int(headerInSize) || n < int(ctx.len) {
+		c.releaseCtx(ctx)
 		return fmt.Errorf("unexpected request size: %d", n)
 	}
 
@@ -194,28 +596,180 @@ func (c *conn) accept() (err error) {
 		ctx, ctx.Header.ID, ctx.Header.NodeID, ctx.Header.UID, ctx.Header.GID,
 		ctx.Header.PID, ctx.Header.len)
 
-	// todo: goroutine
 	ctx.off = int(ctx.len)
-	if err := c.handle(ctx); err != nil {
-		return fmt.Errorf("%s: %w", ctx, err)
+
+	// Requests without a reply are handled in the order they're received.
+	// Forgets can't overtake the lookups they balance, since the kernel only
+	// sends them after receiving the lookup's reply, and those are written
+	// once the handler is complete.
+	switch {
+	case !c.ready, ctx.Op == proto.FORGET, ctx.Op == proto.BATCH_FORGET,
+		ctx.Op == proto.INTERRUPT, ctx.Op == proto.DESTROY,
+		ctx.Op == proto.NOTIFY_REPLY:
+		err := c.handle(ctx)
+		c.releaseCtx(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ctx, err)
+		}
+		return nil
+	}
+
+	if err := c.track(ctx); err != nil {
+		c.releaseCtx(ctx)
+		return err
+	}
+
+	// Readers never wait for a worker, so that the requests needed to unblock
+	// running handlers, such as interrupts and unlocks, can always be read.
+	// Those releasing locks are also handled without a worker, since all of
+	// the workers may be held by handlers waiting on them. The kernel already
+	// bounds the number of outstanding requests.
+	c.haltMu.RLock()
+	select {
+	case <-c.done:
+		c.haltMu.RUnlock()
+		c.untrack(ctx)
+		if err := c.writeErr(ctx.ID, syscall.ENOTCONN); err != nil {
+			c.logf("%s: %v", ctx, err)
+		}
+		c.releaseCtx(ctx)
+		return ErrServerClosed
+	default:
 	}
+	c.wg.Add(1)
+	c.pending.Add(1)
+	c.haltMu.RUnlock()
 
-	c.sem.release(1)
-	c.releaseCtx(ctx)
+	go func() {
+		defer c.wg.Done()
+		defer c.pending.Done()
+		var err error
+		if unblocks(ctx) {
+			err = c.handle(ctx)
+		} else {
+			err = c.work(ctx)
+		}
+		if err == errCancelled {
+			c.debugf("%s: %v before it was handled", ctx, ctx.Err())
+			errno := syscall.EINTR
+			if ctx.Err() == context.DeadlineExceeded {
+				errno = syscall.ETIMEDOUT
+			}
+			err = c.writeErr(ctx.ID, errno)
+		}
+		c.untrack(ctx)
+		if err != nil {
+			c.logf("%s: %v", ctx, err)
+		}
+		c.releaseCtx(ctx)
+	}()
 	return nil
 }
 
+// errCancelled is returned by work if the request ended before a worker was
+// available
+var errCancelled = errors.New("fuse: request cancelled")
+
+// work handles the request once a worker is available
+func (c *conn) work(ctx *Context) error {
+	select {
+	case c.workers <- struct{}{}:
+	case <-ctx.Done():
+		return errCancelled
+	}
+	ctx.worker = true
+	err := c.handle(ctx)
+	if ctx.worker {
+		ctx.worker = false
+		<-c.workers
+	}
+	return err
+}
+
+// unblocks reports whether the request may release locks that other handlers
+// are waiting for
+func unblocks(ctx *Context) bool {
+	switch ctx.Op {
+	case proto.FLUSH, proto.RELEASE:
+		return true
+	case proto.SETLK, proto.SETLKW:
+		return (*proto.LkIn)(ctx.in()).Lk.Type == syscall.F_UNLCK
+	}
+	return false
+}
+
+// read a request from the device. Readers normally wait on the runtime's
+// poller, which is stuck while any goroutine adds a file of this filesystem to
+// an epoll set, such as through os.Open, until the kernel's POLL request has
+// been answered. The direct reader waits with poll(2) instead, so that such
+// requests can always be read, whether or not the filesystem implements Poll.
+// It ignores read deadlines, and is woken by halt instead.
+func (c *conn) read(buf []byte) (int, error) {
+	if c.direct == nil {
+		return c.dev.Read(buf)
+	}
+	rawConn, err := c.dev.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	wake := int32(c.direct.Fd())
+	ctrlErr := rawConn.Control(func(fd uintptr) {
+		fds := []unix.PollFd{
+			{Fd: int32(fd), Events: unix.POLLIN},
+			{Fd: wake, Events: unix.POLLIN},
+		}
+		for {
+			if _, err = unix.Poll(fds, -1); err == unix.EINTR {
+				continue
+			} else if err != nil {
+				return
+			}
+			if fds[1].Revents != 0 {
+				err = ErrServerClosed
+				return
+			}
+			if n, err = unix.Read(int(fd), buf); err != unix.EAGAIN {
+				return
+			}
+		}
+	})
+	switch {
+	case ctrlErr != nil:
+		return 0, ctrlErr
+	case err == ErrServerClosed:
+		return 0, err
+	case err != nil:
+		return 0, &os.PathError{Op: "read", Path: c.dev.Name(), Err: err}
+	case n == 0:
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
 func (c *conn) handle(ctx *Context) error {
 	var err error
 	var size uintptr
 
+	// called if the response could not be delivered
+	var undo func()
+
+	if c.denied(ctx) {
+		c.debugf("%s: denied request from UID %d", ctx, ctx.UID)
+		return c.writeErr(ctx.ID, syscall.EACCES)
+	}
+
 	switch ctx.Op {
 	case proto.LOOKUP:
 		size = unsafe.Sizeof(LookupOut{})
-		err = c.fs.Lookup(ctx, &LookupIn{Name: ctx.string()}, (*LookupOut)(ctx.outzero(size)))
+		err = c.fs.Lookup(ctx, &LookupIn{Name: ctx.string(0)}, (*LookupOut)(ctx.outzero(size)))
 	case proto.FORGET:
 		c.fs.Forget(ctx, (*ForgetIn)(ctx.in()))
 		return nil
+	case proto.BATCH_FORGET:
+		c.batchForget(ctx)
+		return nil
 	case proto.GETATTR:
 		if c.minor < 9 {
 			ctx.shift(int(unsafe.Sizeof(GetattrIn{})))
@@ -230,38 +784,39 @@ func (c *conn) handle(ctx *Context) error {
 		err = c.fs.Readlink(ctx, &out)
 		size = uintptr(ctx.writeString(out.Name))
 	case proto.SYMLINK:
-		names := ctx.strings(2)
+		names := ctx.strings(0, 2)
 		size = unsafe.Sizeof(SymlinkOut{})
 		err = c.fs.Symlink(ctx, &SymlinkIn{Name: names[0], Linkname: names[1]}, (*SymlinkOut)(ctx.outzero(size)))
 	case proto.MKNOD:
-		if c.minor < 12 {
-			ctx.shift(int(unsafe.Sizeof(proto.MknodIn{})) - proto.COMPAT_MKNOD_IN_SIZE)
-		}
 		rawIn := (*proto.MknodIn)(ctx.in())
 		in := MknodIn{
-			Name:  ctx.string(),
-			Mode:  rawIn.Mode,
-			Rdev:  rawIn.Rdev,
-			Umask: rawIn.Umask,
+			Mode: rawIn.Mode,
+			Rdev: rawIn.Rdev,
+		}
+		if c.minor < 12 {
+			in.Name = ctx.string(proto.COMPAT_MKNOD_IN_SIZE)
+		} else {
+			in.Name = ctx.string(unsafe.Sizeof(*rawIn))
+			in.Umask = rawIn.Umask
 		}
 		size = unsafe.Sizeof(MknodOut{})
 		err = c.fs.Mknod(ctx, &in, (*MknodOut)(ctx.outzero(size)))
 	case proto.MKDIR:
 		rawIn := (*proto.MkdirIn)(ctx.in())
 		in := &MkdirIn{
-			Name:  ctx.string(),
+			Name:  ctx.string(unsafe.Sizeof(*rawIn)),
 			Mode:  rawIn.Mode,
 			Umask: rawIn.Umask,
 		}
 		size = unsafe.Sizeof(MkdirOut{})
 		err = c.fs.Mkdir(ctx, in, (*MkdirOut)(ctx.outzero(size)))
 	case proto.UNLINK:
-		err = c.fs.Unlink(ctx, &UnlinkIn{Name: ctx.string()})
+		err = c.fs.Unlink(ctx, &UnlinkIn{Name: ctx.string(0)})
 	case proto.RMDIR:
-		err = c.fs.Rmdir(ctx, &RmdirIn{Name: ctx.string()})
+		err = c.fs.Rmdir(ctx, &RmdirIn{Name: ctx.string(0)})
 	case proto.RENAME:
-		names := ctx.strings(2)
 		raw := (*proto.RenameIn)(ctx.in())
+		names := ctx.strings(unsafe.Sizeof(*raw), 2)
 		err = c.fs.Rename(ctx, &RenameIn{
 			Name:    names[0],
 			Newname: names[1],
@@ -271,7 +826,6 @@ func (c *conn) handle(ctx *Context) error {
 		size = unsafe.Sizeof(LinkOut{})
 		err = c.fs.Link(ctx, (*LinkIn)(ctx.in()), (*LinkOut)(ctx.outzero(size)))
 	case proto.OPEN:
-		// todo: pre-set flags for entryout requests?
 		size = unsafe.Sizeof(OpenOut{})
 		err = c.fs.Open(ctx, (*OpenIn)(ctx.in()), (*OpenOut)(ctx.outzero(size)))
 	case proto.READ:
@@ -280,17 +834,67 @@ func (c *conn) handle(ctx *Context) error {
 		err = c.fs.Read(ctx, (*ReadIn)(ctx.in()), &ReadOut{Data: ctx.outData()})
 		size = uintptr(len(ctx.outData()))
 	case proto.WRITE:
+		raw := (*proto.WriteIn)(ctx.in())
+		in := WriteIn{
+			Fh:         raw.Fh,
+			Offset:     raw.Offset,
+			WriteFlags: WriteFlags(raw.WriteFlags),
+		}
+		off := unsafe.Sizeof(proto.WriteIn{})
+		if c.minor < 9 {
+			off = proto.COMPAT_WRITE_IN_SIZE
+		} else {
+			in.LockOwner = raw.LockOwner
+			in.Flags = FileFlags(raw.Flags)
+		}
+		data := ctx.bytes(off)
+		if uint32(len(data)) < raw.Size {
+			err = fmt.Errorf("%w: write size (%d) exceeds payload (%d)", EPROTO, raw.Size, len(data))
+			break
+		}
+		in.Data = data[:raw.Size]
+		size = unsafe.Sizeof(WriteOut{})
+		err = c.fs.Write(ctx, &in, (*WriteOut)(ctx.outzero(size)))
 	case proto.STATFS:
+		size = unsafe.Sizeof(StatfsOut{})
+		err = c.fs.Statfs(ctx, (*StatfsOut)(ctx.outzero(size)))
+		if c.minor < 4 {
+			size = proto.COMPAT_STATFS_SIZE
+		}
 	case proto.RELEASE:
-		// todo: lock handling
+		in := (*ReleaseIn)(ctx.in())
+		if in.ReleaseFlags.Flush() {
+			c.locks.ReleaseOwner(ctx.NodeID, in.LockOwner, false)
+		}
+		if in.ReleaseFlags.FlockUnlock() {
+			c.locks.ReleaseOwner(ctx.NodeID, in.LockOwner, true)
+		}
+		err = c.fs.Release(ctx, in)
 	case proto.FSYNC:
+		err = c.fs.Fsync(ctx, (*FsyncIn)(ctx.in()))
 	case proto.SETXATTR:
+		raw := (*proto.SetxattrIn)(ctx.in())
+		in := SetxattrIn{
+			Name:  ctx.string(unsafe.Sizeof(*raw)),
+			Flags: SetxattrFlags(raw.Flags),
+		}
+		value := ctx.bytes(unsafe.Sizeof(*raw) + uintptr(len(in.Name)) + 1)
+		if uint32(len(value)) < raw.Size {
+			err = fmt.Errorf("%w: xattr size (%d) exceeds payload (%d)", EPROTO, raw.Size, len(value))
+			break
+		}
+		in.Value = value[:raw.Size]
+		err = c.fs.Setxattr(ctx, &in)
 	case proto.GETXATTR:
-		size = unsafe.Sizeof(GetxattrOut{})
-		err = c.fs.Getxattr(ctx, (*GetxattrIn)(ctx.in()), (*GetxattrOut)(ctx.out()))
+		size, err = ctx.handleGetxattr((*proto.GetxattrIn)(ctx.in()))
 	case proto.LISTXATTR:
+		size, err = ctx.handleListxattr((*proto.GetxattrIn)(ctx.in()))
 	case proto.REMOVEXATTR:
+		err = c.fs.Removexattr(ctx, &RemovexattrIn{Name: ctx.string(0)})
 	case proto.FLUSH:
+		in := (*FlushIn)(ctx.in())
+		c.locks.ReleaseOwner(ctx.NodeID, in.LockOwner, false)
+		err = c.fs.Flush(ctx, in)
 	case proto.INIT:
 		err = ctx.handleInit((*InitIn)(ctx.in()), (*InitOut)(ctx.out()))
 		switch {
@@ -302,29 +906,91 @@ func (c *conn) handle(ctx *Context) error {
 			size += unsafe.Sizeof(InitOut{})
 		}
 	case proto.OPENDIR:
+		size = unsafe.Sizeof(OpendirOut{})
+		err = c.fs.Opendir(ctx, (*OpendirIn)(ctx.in()), (*OpendirOut)(ctx.outzero(size)))
 	case proto.READDIR:
+		in := (*ReaddirIn)(ctx.in())
+		out := ReaddirOut{buf: ctx.outLimit(in.Size)}
+		err = c.fs.Readdir(ctx, in, &out)
+		size = uintptr(out.n)
 	case proto.RELEASEDIR:
+		err = c.fs.Releasedir(ctx, (*ReleaseIn)(ctx.in()))
 	case proto.FSYNCDIR:
+		err = c.fs.Fsyncdir(ctx, (*FsyncIn)(ctx.in()))
 	case proto.GETLK:
+		size = unsafe.Sizeof(LkOut{})
+		err = c.fs.Getlk(ctx, (*LkIn)(ctx.in()), (*LkOut)(ctx.outzero(size)))
 	case proto.SETLK:
+		err = c.fs.Setlk(ctx, (*LkIn)(ctx.in()))
 	case proto.SETLKW:
+		err = c.fs.Setlkw(ctx, (*LkIn)(ctx.in()))
 	case proto.ACCESS:
 		err = c.fs.Access(ctx, (*AccessIn)(ctx.in()))
 	case proto.CREATE:
+		// the kernel falls back to MKNOD and OPEN once CREATE is rejected
+		if atomic.LoadUint32(&c.noCreate) != 0 {
+			err = ENOSYS
+			break
+		}
+		rawIn := (*proto.CreateIn)(ctx.in())
+		in := CreateIn{
+			Flags: FileFlags(rawIn.Flags),
+			Mode:  rawIn.Mode,
+		}
+		if c.minor < 12 {
+			in.Name = ctx.string(unsafe.Sizeof(proto.OpenIn{}))
+		} else {
+			in.Name = ctx.string(unsafe.Sizeof(*rawIn))
+			in.Umask = rawIn.Umask
+		}
+		size = unsafe.Sizeof(CreateOut{})
+		err = c.fs.Create(ctx, &in, (*CreateOut)(ctx.outzero(size)))
+		if errors.Is(err, ENOSYS) {
+			c.debugf("CREATE not implemented, falling back to MKNOD and OPEN")
+			atomic.StoreUint32(&c.noCreate, 1)
+		}
 	case proto.INTERRUPT:
+		c.interrupt(ctx, (*proto.InterruptIn)(ctx.in()).Unique)
+		return nil
 	case proto.BMAP:
 	case proto.DESTROY:
-		// todo: server shutdown
-		err = c.fs.Destroy(ctx)
+		// sent as the filesystem is unmounted, once all other requests have
+		// been replied to. Handlers may still be running for interrupted ones.
+		// This runs on a poll loop, so it can't wait for the others, but none
+		// can start a handler once halted.
+		c.halt()
+		c.wg.Wait()
+		err = c.finish(ctx, ErrDestroyed)
 	case proto.IOCTL:
+		size, err = ctx.handleIoctl((*proto.IoctlIn)(ctx.in()))
 	case proto.POLL:
+		raw := (*proto.PollIn)(ctx.in())
+		in := PollIn{
+			Fh:    raw.Fh,
+			Flags: PollFlags(raw.Flags),
+		}
+		if c.minor >= 21 {
+			in.Events = raw.Events
+		}
+		if in.Flags.ScheduleNotify() {
+			in.Handle = &PollHandle{kh: raw.Kh, sess: c.session}
+		}
+		size = unsafe.Sizeof(PollOut{})
+		err = c.fs.Poll(ctx, &in, (*PollOut)(ctx.outzero(size)))
 	case proto.NOTIFY_REPLY:
-	case proto.BATCH_FORGET:
+		c.notifyReply(ctx)
+		return nil
 	case proto.FALLOCATE:
+		err = c.fs.Fallocate(ctx, (*FallocateIn)(ctx.in()))
 	case proto.READDIRPLUS:
+		in := (*ReaddirplusIn)(ctx.in())
+		out := ReaddirplusOut{buf: ctx.outLimit(in.Size)}
+		err = ctx.handleReaddirplus(in, &out)
+		size = uintptr(out.n)
+		undo = func() { out.forget(ctx, c.fs) }
 	case proto.RENAME2:
-		names := ctx.strings(2)
 		raw := (*proto.Rename2In)(ctx.in())
+		names := ctx.strings(unsafe.Sizeof(*raw), 2)
 		err = c.fs.Rename(ctx, &RenameIn{
 			Name:    names[0],
 			Newname: names[1],
@@ -335,18 +1001,26 @@ func (c *conn) handle(ctx *Context) error {
 		size = unsafe.Sizeof(LseekOut{})
 		err = c.fs.Lseek(ctx, (*LseekIn)(ctx.in()), (*LseekOut)(ctx.outzero(size)))
 	case proto.COPY_FILE_RANGE:
-		err = c.fs.CopyFileRange(ctx, (*CopyFileRangeIn)(ctx.in()))
-		// todo: reply write
+		size = unsafe.Sizeof(WriteOut{})
+		err = c.fs.CopyFileRange(ctx, (*CopyFileRangeIn)(ctx.in()), (*WriteOut)(ctx.outzero(size)))
 	default:
-		return fmt.Errorf("%w: (%d)", ErrUnsupportedOp, ctx.Op)
+		c.debugf("%v: %s", ErrUnsupportedOp, ctx.Op)
+		err = ENOSYS
 	}
 
 	var errno syscall.Errno
 	switch {
 	case errors.As(err, &errno) && errno != 0:
 		size, err = 0, nil
+		if undo != nil {
+			undo()
+		}
 	case err != nil:
-		return fmt.Errorf("handler error in %s: %w", ctx, err)
+		c.logf("handler error in %s: %v", ctx, err)
+		size, err, errno = 0, nil, syscall.EIO
+		if undo != nil {
+			undo()
+		}
 	}
 
 	header := ctx.outHeader()
@@ -356,36 +1030,164 @@ func (c *conn) handle(ctx *Context) error {
 		Unique: ctx.ID,
 	}
 
+	c.debugf("send %s {ID:%d Error:%d Len:%d}",
+		ctx, header.Unique, header.Error, header.Len)
+	if err := c.write(ctx.outBuf()[:header.Len]); err != nil {
+		if undo != nil {
+			undo()
+		}
+		// the kernel has already abandoned an interrupted request
+		if errors.Is(err, syscall.ENOENT) {
+			c.debugf("%s: request %d no longer exists", ctx, ctx.ID)
+			return nil
+		}
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+// denied reports whether the request must be rejected under AllowRoot. As in
+// libfuse, operations on files that are already open are always permitted.
+func (s *session) denied(ctx *Context) bool {
+	if !s.opts.denyOthers || ctx.UID == 0 || ctx.UID == s.opts.owner {
+		return false
+	}
+	switch ctx.Op {
+	case proto.INIT, proto.READ, proto.WRITE, proto.FSYNC, proto.RELEASE,
+		proto.READDIR, proto.READDIRPLUS, proto.FSYNCDIR, proto.RELEASEDIR,
+		proto.FORGET, proto.BATCH_FORGET, proto.INTERRUPT, proto.NOTIFY_REPLY:
+		return false
+	}
+	return true
+}
+
+func (c *conn) write(buf []byte) error {
 	if c.opts.WriteTimeout > 0 {
+		// fails once the device is closed by an aborted shutdown
 		deadline := time.Now().Add(c.opts.WriteTimeout)
 		if err := c.dev.SetWriteDeadline(deadline); err != nil {
-			panic(err)
+			return err
 		}
 	}
+	_, err := c.dev.Write(buf)
+	return err
+}
 
-	c.debugf("send %s {ID:%d Error:%d Len:%d}",
-		ctx, header.Unique, header.Error, header.Len)
-	if _, err = c.dev.Write(ctx.outBuf()[:header.Len]); err != nil {
-		return fmt.Errorf("failed to write response: %w", err)
+// reply to a request with an error and no payload
+func (c *conn) writeErr(unique uint64, errno syscall.Errno) error {
+	var header [headerOutSize]byte
+	*(*proto.OutHeader)(unsafe.Pointer(&header[0])) = proto.OutHeader{
+		Len:    uint32(headerOutSize),
+		Error:  -int32(errno),
+		Unique: unique,
+	}
+	c.debugf("send {ID:%d Error:%d}", unique, -int32(errno))
+	return c.write(header[:])
+}
+
+// track registers ctx as an in-flight request, so that it may be interrupted.
+func (c *conn) track(ctx *Context) error {
+	var deadline time.Time
+	if c.opts.RequestTimeout > 0 {
+		deadline = time.Now().Add(c.opts.RequestTimeout)
+	}
+	ctx.reset(deadline)
+
+	c.reqMu.Lock()
+	c.requests[ctx.ID] = ctx
+
+	// The kernel only interrupts requests that have already been read, so an
+	// interrupt without a matching request either raced with the request's
+	// arrival on another connection, or with its reply. Like libfuse, wait for
+	// the next request before answering EAGAIN, which causes the kernel to
+	// requeue the interrupt if the request is still pending.
+	var stale uint64
+	if _, ok := c.interrupts[ctx.ID]; ok {
+		delete(c.interrupts, ctx.ID)
+		ctx.interrupt()
+	} else {
+		for target, unique := range c.interrupts {
+			delete(c.interrupts, target)
+			stale = unique
+			break
+		}
+	}
+	c.reqMu.Unlock()
+
+	if stale != 0 {
+		if err := c.writeErr(stale, syscall.EAGAIN); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to write response: %w", err)
+		}
 	}
 	return nil
 }
 
-func (c *conn) acquireCtx() (ctx *Context) {
-	v := ctxPool.Get()
+func (c *conn) untrack(ctx *Context) {
+	c.reqMu.Lock()
+	delete(c.requests, ctx.ID)
+	c.reqMu.Unlock()
+	ctx.interrupt()
+}
+
+// interrupt the request identified by target. INTERRUPT is only replied to
+// when the target cannot be found.
+func (c *conn) interrupt(ctx *Context, target uint64) {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+
+	if r, ok := c.requests[target]; ok {
+		c.debugf("interrupting %s {ID:%d}", r, target)
+		r.interrupt()
+		return
+	}
+	c.interrupts[target] = ctx.ID
+}
+
+func (c *conn) batchForget(ctx *Context) {
+	nodeid := ctx.NodeID
+	defer func() { ctx.NodeID = nodeid }()
+
+	raw := (*proto.BatchForgetIn)(ctx.in())
+	buf := ctx.bytes(unsafe.Sizeof(*raw))
+	for i := uint32(0); i < raw.Count; i++ {
+		const size = int(unsafe.Sizeof(proto.ForgetOne{}))
+		if len(buf) < size {
+			c.logf("%s: truncated request", ctx)
+			return
+		}
+		one := (*proto.ForgetOne)(unsafe.Pointer(&buf[0]))
+		ctx.NodeID = one.Nodeid
+		c.fs.Forget(ctx, &ForgetIn{NLookup: one.Nlookup})
+		buf = buf[size:]
+	}
+}
+
+// cancel all in-flight requests
+func (s *session) cancelRequests() {
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+
+	for _, ctx := range s.requests {
+		ctx.interrupt()
+	}
+}
+
+func (s *session) acquireCtx() (ctx *Context) {
+	v := s.pool.Get()
 	if v == nil {
-		buf := make([]byte, 64*1024)
-		ctx = (*Context)(unsafe.Pointer(&buf[0]))
-		ctx.buf = buf[unsafe.Offsetof(ctx.Header):]
+		// the request header is read directly into buf. Context must live
+		// outside of it, since buf is not scanned by the garbage collector.
+		ctx = &Context{buf: make([]byte, s.opts.bufSize)}
+		ctx.Header = (*Header)(unsafe.Pointer(&ctx.buf[0]))
 	} else {
 		ctx = v.(*Context)
 	}
-	ctx.sess = c.session
+	ctx.sess = s
 	return ctx
 }
 
-func (c *conn) releaseCtx(r *Context) {
-	ctxPool.Put(r)
+func (s *session) releaseCtx(r *Context) {
+	s.pool.Put(r)
 }
 
 func closeErr(closer io.Closer, err *error) {
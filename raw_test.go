@@ -1,12 +1,24 @@
 package fuse
 
 import (
+	"container/list"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"bytelog.org/fuse/proto"
 )
 
 type loggy struct {
@@ -100,3 +112,513 @@ func assert(t *testing.T, err error) {
 		t.Errorf("%v", err)
 	}
 }
+
+func TestNewOpts(t *testing.T) {
+	v, err := newOpts(&Options{})
+	assert(t, err)
+	if v.MaxBackground != 16 || v.CongestionThreshold != 12 || v.MaxPages != 32 {
+		t.Errorf("unexpected defaults: %+v", v)
+	}
+	if v.WriteTimeout != time.Second || v.RequestTimeout != 0 {
+		t.Errorf("requests should have no deadline by default: %+v", v)
+	}
+
+	v, err = newOpts(&Options{MaxPages: 256, MaxBackground: 64, TimeGran: time.Microsecond})
+	assert(t, err)
+	if v.CongestionThreshold != 48 || v.TimeGran != 1000 {
+		t.Errorf("unexpected options: %+v", v)
+	}
+	if v.MaxWrite != 256*uint32(os.Getpagesize()) || v.bufSize != int(v.MaxWrite)+4096 {
+		t.Errorf("unexpected sizes: MaxWrite %d, bufSize %d", v.MaxWrite, v.bufSize)
+	}
+
+	for _, o := range []Options{
+		{MaxWorkers: -1},
+		{MinReaders: 8, MaxReaders: 2},
+		{MaxPages: 257},
+		{MaxWrite: 100},
+		{MaxWrite: 1 << 30},
+		{MaxBackground: 4, CongestionThreshold: 8},
+		{TimeGran: 2 * time.Second},
+		{TimeGran: 20 * time.Microsecond},
+	} {
+		if _, err := newOpts(&o); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("expected ErrInvalidOption for %+v, got %v", o, err)
+		}
+	}
+}
+
+// testSession returns an initialized session, served on one end of a socket
+// pair. The other end is returned to act as the kernel. Callers should halt
+// the session before closing the kernel's end.
+func testSession(t *testing.T, fs Filesystem, o Options) (*session, *os.File) {
+	t.Helper()
+	s, kernel := newTestSession(t, fs, o)
+	s.serve(&conn{session: s, dev: s.dev})
+	return s, kernel
+}
+
+// newTestSession is like testSession, but the session is not yet served
+func newTestSession(t *testing.T, fs Filesystem, o Options) (*session, *os.File) {
+	t.Helper()
+	opts, err := newOpts(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &session{
+		logger:     &logger{ErrorLog: log.New(ioutil.Discard, "", 0)},
+		fs:         fs,
+		opts:       opts,
+		requests:   make(map[uint64]*Context),
+		interrupts: make(map[uint64]uint64),
+		retrieves:  make(map[uint64]chan []byte),
+		done:       make(chan struct{}),
+		starved:    make(chan struct{}, 1),
+		ended:      func(error) {},
+		ready:      true,
+		minor:      proto.KERNEL_MINOR_VERSION,
+		dev:        os.NewFile(uintptr(fds[0]), "dev"),
+		conns:      list.New(),
+		workers:    make(chan struct{}, opts.MaxWorkers),
+	}
+	return s, os.NewFile(uintptr(fds[1]), "kernel")
+}
+
+// send a request to the session, as the kernel
+func send(t *testing.T, kernel *os.File, op proto.OpCode, unique uint64, in interface{}) {
+	t.Helper()
+	var data []byte
+	switch in := in.(type) {
+	case nil:
+	case *proto.InterruptIn:
+		data = (*[unsafe.Sizeof(*in)]byte)(unsafe.Pointer(in))[:]
+	case *proto.GetattrIn:
+		data = (*[unsafe.Sizeof(*in)]byte)(unsafe.Pointer(in))[:]
+	case *proto.InitIn:
+		data = (*[unsafe.Sizeof(*in)]byte)(unsafe.Pointer(in))[:]
+	case *proto.LkIn:
+		data = (*[unsafe.Sizeof(*in)]byte)(unsafe.Pointer(in))[:]
+	case []byte:
+		data = in
+	default:
+		t.Fatalf("unsupported request %T", in)
+	}
+	buf := make([]byte, int(headerInSize)+len(data))
+	*(*proto.InHeader)(unsafe.Pointer(&buf[0])) = proto.InHeader{
+		Len:    uint32(len(buf)),
+		OpCode: op,
+		Unique: unique,
+		Nodeid: 1,
+	}
+	copy(buf[headerInSize:], data)
+	if _, err := kernel.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recv a reply from the session, as the kernel
+func recv(t *testing.T, kernel *os.File) proto.OutHeader {
+	t.Helper()
+	if err := kernel.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < int(headerOutSize) {
+		t.Fatalf("short reply: %d", n)
+	}
+	return *(*proto.OutHeader)(unsafe.Pointer(&buf[0]))
+}
+
+func TestWorkersInterrupt(t *testing.T) {
+	started := make(chan uint64, 2)
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		if ctx.Op != proto.GETATTR {
+			return DefaultFilesystem(ctx, req, resp)
+		}
+		started <- ctx.ID
+		<-ctx.Interrupt()
+		return syscall.EINTR
+	})
+	s, kernel := testSession(t, fs, Options{MaxWorkers: 1})
+	defer kernel.Close()
+	defer s.halt()
+
+	// the only worker is blocked, and a second request waits for it
+	send(t, kernel, proto.GETATTR, 2, &proto.GetattrIn{})
+	if id := <-started; id != 2 {
+		t.Fatalf("unexpected request %d", id)
+	}
+	send(t, kernel, proto.GETATTR, 4, &proto.GetattrIn{})
+
+	// both must still be interruptible
+	send(t, kernel, proto.INTERRUPT, 5, &proto.InterruptIn{Unique: 4})
+	if h := recv(t, kernel); h.Unique != 4 || h.Error != -int32(syscall.EINTR) {
+		t.Errorf("unexpected reply: %+v", h)
+	}
+	send(t, kernel, proto.INTERRUPT, 7, &proto.InterruptIn{Unique: 2})
+	if h := recv(t, kernel); h.Unique != 2 || h.Error != -int32(syscall.EINTR) {
+		t.Errorf("unexpected reply: %+v", h)
+	}
+	select {
+	case id := <-started:
+		t.Errorf("interrupted request %d should not be handled", id)
+	default:
+	}
+}
+
+func TestWriteIn(t *testing.T) {
+	raw := proto.WriteIn{
+		Fh:         3,
+		Offset:     4096,
+		Size:       5,
+		WriteFlags: proto.WRITE_LOCKOWNER | proto.WRITE_KILL_PRIV,
+		LockOwner:  7,
+		Flags:      syscall.O_RDWR,
+	}
+	header := (*[unsafe.Sizeof(raw)]byte)(unsafe.Pointer(&raw))[:]
+
+	tests := []struct {
+		minor uint32
+		in    []byte
+		want  WriteIn
+	}{
+		{proto.KERNEL_MINOR_VERSION, header, WriteIn{LockOwner: 7, Flags: syscall.O_RDWR}},
+		{8, header[:proto.COMPAT_WRITE_IN_SIZE], WriteIn{}},
+	}
+	for _, tt := range tests {
+		var got WriteIn
+		fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+			if ctx.Op != proto.WRITE {
+				return DefaultFilesystem(ctx, req, resp)
+			}
+			got = *req.(*WriteIn)
+			got.Data = append([]byte(nil), got.Data...)
+			resp.(*WriteOut).Size = uint32(len(got.Data))
+			return nil
+		})
+		s, kernel := newTestSession(t, fs, Options{})
+		s.minor = tt.minor
+		s.serve(&conn{session: s, dev: s.dev})
+
+		in := append(append([]byte(nil), tt.in...), "hello, trailing"...)
+		send(t, kernel, proto.WRITE, 2, in)
+		if h := recv(t, kernel); h.Error != 0 {
+			t.Errorf("7.%d: unexpected reply: %+v", tt.minor, h)
+		}
+		s.halt()
+		kernel.Close()
+
+		if got.Fh != 3 || got.Offset != 4096 || string(got.Data) != "hello" {
+			t.Errorf("7.%d: unexpected request: %+v", tt.minor, got)
+		}
+		if got.LockOwner != tt.want.LockOwner || got.Flags != tt.want.Flags {
+			t.Errorf("7.%d: expected %+v, got %+v", tt.minor, tt.want, got)
+		}
+		if f := got.WriteFlags; !f.LockOwner() || !f.KillPriv() || f.Cache() {
+			t.Errorf("7.%d: unexpected flags: %#x", tt.minor, f)
+		}
+	}
+}
+
+func TestCreateFallback(t *testing.T) {
+	var ops []string
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		switch in := req.(type) {
+		case *CreateIn:
+			ops = append(ops, "create "+in.Name)
+		case *MknodIn:
+			ops = append(ops, "mknod "+in.Name)
+			return nil
+		case *OpenIn:
+			ops = append(ops, "open")
+			return nil
+		}
+		return DefaultFilesystem(ctx, req, resp)
+	})
+	s, kernel := testSession(t, fs, Options{})
+	defer kernel.Close()
+	defer s.halt()
+
+	create := proto.CreateIn{Flags: syscall.O_RDWR, Mode: syscall.S_IFREG | 0644}
+	mknod := proto.MknodIn{Mode: syscall.S_IFREG | 0644}
+	open := proto.OpenIn{Flags: syscall.O_RDWR}
+	bytes := func(p unsafe.Pointer, size uintptr, name string) []byte {
+		b := append([]byte(nil), (*[4096]byte)(p)[:size]...)
+		if name != "" {
+			b = append(b, name+"\x00"...)
+		}
+		return b
+	}
+
+	// once CREATE is rejected, the filesystem is no longer asked, while the
+	// kernel falls back to MKNOD and OPEN
+	for i, unique := range []uint64{2, 6} {
+		send(t, kernel, proto.CREATE, unique, bytes(unsafe.Pointer(&create), unsafe.Sizeof(create), "a"))
+		if h := recv(t, kernel); h.Unique != unique || h.Error != -int32(syscall.ENOSYS) {
+			t.Errorf("%d: unexpected reply: %+v", i, h)
+		}
+		if atomic.LoadUint32(&s.noCreate) == 0 {
+			t.Errorf("%d: CREATE should be disabled", i)
+		}
+		send(t, kernel, proto.MKNOD, unique+1, bytes(unsafe.Pointer(&mknod), unsafe.Sizeof(mknod), "a"))
+		if h := recv(t, kernel); h.Unique != unique+1 || h.Error != 0 {
+			t.Errorf("%d: unexpected reply: %+v", i, h)
+		}
+		send(t, kernel, proto.OPEN, unique+2, bytes(unsafe.Pointer(&open), unsafe.Sizeof(open), ""))
+		if h := recv(t, kernel); h.Unique != unique+2 || h.Error != 0 {
+			t.Errorf("%d: unexpected reply: %+v", i, h)
+		}
+	}
+	if got := fmt.Sprint(ops); got != "[create a mknod a open mknod a open]" {
+		t.Errorf("unexpected requests: %s", got)
+	}
+}
+
+func TestInterruptUnmatched(t *testing.T) {
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		if ctx.Op != proto.GETATTR {
+			return DefaultFilesystem(ctx, req, resp)
+		}
+		select {
+		case <-ctx.Interrupt():
+			return syscall.EINTR
+		default:
+			return nil
+		}
+	})
+	s, kernel := testSession(t, fs, Options{})
+	defer kernel.Close()
+	defer s.halt()
+
+	// an interrupt arriving before its target is kept for it
+	send(t, kernel, proto.INTERRUPT, 3, &proto.InterruptIn{Unique: 2})
+	send(t, kernel, proto.GETATTR, 2, &proto.GetattrIn{})
+	if h := recv(t, kernel); h.Unique != 2 || h.Error != -int32(syscall.EINTR) {
+		t.Errorf("unexpected reply: %+v", h)
+	}
+
+	// otherwise, it's answered with EAGAIN once the next request arrives
+	send(t, kernel, proto.INTERRUPT, 5, &proto.InterruptIn{Unique: 100})
+	send(t, kernel, proto.GETATTR, 6, &proto.GetattrIn{})
+	if h := recv(t, kernel); h.Unique != 5 || h.Error != -int32(syscall.EAGAIN) {
+		t.Errorf("unexpected reply: %+v", h)
+	}
+	if h := recv(t, kernel); h.Unique != 6 || h.Error != 0 {
+		t.Errorf("unexpected reply: %+v", h)
+	}
+}
+
+func TestWorkersTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		if ctx.Op != proto.GETATTR {
+			return DefaultFilesystem(ctx, req, resp)
+		}
+		close(started)
+		<-release
+		return nil
+	})
+	s, kernel := testSession(t, fs, Options{MaxWorkers: 1, RequestTimeout: 50 * time.Millisecond})
+	defer kernel.Close()
+	defer s.halt()
+
+	// the second request expires while waiting for the only worker
+	send(t, kernel, proto.GETATTR, 2, &proto.GetattrIn{})
+	<-started
+	send(t, kernel, proto.GETATTR, 4, &proto.GetattrIn{})
+	if h := recv(t, kernel); h.Unique != 4 || h.Error != -int32(syscall.ETIMEDOUT) {
+		t.Errorf("unexpected reply: %+v", h)
+	}
+	close(release)
+	if h := recv(t, kernel); h.Unique != 2 || h.Error != 0 {
+		t.Errorf("unexpected reply: %+v", h)
+	}
+}
+
+func TestWorkersLock(t *testing.T) {
+	s, kernel := testSession(t, DefaultFilesystem, Options{MaxWorkers: 1})
+	defer kernel.Close()
+	defer s.halt()
+
+	lk := func(owner uint64, typ uint32) *proto.LkIn {
+		return &proto.LkIn{Owner: owner, Lk: proto.FileLock{End: ^uint64(0), Type: typ}}
+	}
+	send(t, kernel, proto.SETLK, 2, lk(1, syscall.F_WRLCK))
+	if h := recv(t, kernel); h.Unique != 2 || h.Error != 0 {
+		t.Fatalf("unexpected reply: %+v", h)
+	}
+
+	// the only worker is given up while waiting for the lock
+	send(t, kernel, proto.SETLKW, 4, lk(2, syscall.F_WRLCK))
+	send(t, kernel, proto.GETATTR, 6, &proto.GetattrIn{})
+	if h := recv(t, kernel); h.Unique != 6 || h.Error != -int32(syscall.ENOSYS) {
+		t.Fatalf("unexpected reply: %+v", h)
+	}
+
+	// and the unlock must be handled, waking the waiter
+	send(t, kernel, proto.SETLK, 8, lk(1, syscall.F_UNLCK))
+	replies := map[uint64]int32{}
+	for i := 0; i < 2; i++ {
+		h := recv(t, kernel)
+		replies[h.Unique] = h.Error
+	}
+	if e, ok := replies[8]; !ok || e != 0 {
+		t.Errorf("unexpected unlock reply: %v", replies)
+	}
+	if e, ok := replies[4]; !ok || e != 0 {
+		t.Errorf("unexpected wait reply: %v", replies)
+	}
+}
+
+func TestDirectRead(t *testing.T) {
+	s, kernel := newTestSession(t, DefaultFilesystem, Options{})
+	defer kernel.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wakeDirect = w
+	s.serve(&conn{session: s, dev: s.dev, direct: r})
+
+	send(t, kernel, proto.GETATTR, 2, &proto.GetattrIn{})
+	if h := recv(t, kernel); h.Unique != 2 || h.Error != -int32(syscall.ENOSYS) {
+		t.Errorf("unexpected reply: %+v", h)
+	}
+
+	// read deadlines are ignored, so the reader must be woken by halt
+	stopped := make(chan struct{})
+	go func() {
+		s.pollers.Wait()
+		close(stopped)
+	}()
+	s.halt()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("direct reader was not woken")
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("wake pipe not closed: %v", err)
+	}
+}
+
+func TestSessionCloseDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		if ctx.Op != proto.GETATTR {
+			return DefaultFilesystem(ctx, req, resp)
+		}
+		close(started)
+		<-release
+		return nil
+	})
+	s, kernel := testSession(t, fs, Options{})
+	defer kernel.Close()
+
+	send(t, kernel, proto.GETATTR, 2, &proto.GetattrIn{})
+	<-started
+
+	closed := make(chan error, 1)
+	go func() { closed <- s.close(context.Background()) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("close returned before the handler completed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-closed; err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+	if h := recv(t, kernel); h.Unique != 2 || h.Error != 0 {
+		t.Errorf("unexpected reply: %+v", h)
+	}
+}
+
+func TestSessionCloseAbort(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	returned := make(chan struct{})
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		switch ctx.Op {
+		case proto.GETATTR:
+		case proto.DESTROY:
+			select {
+			case <-returned:
+			default:
+				t.Error("destroyed while a handler was running")
+			}
+			return nil
+		default:
+			return DefaultFilesystem(ctx, req, resp)
+		}
+		close(started)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+
+		// slow to return, even once cancelled
+		time.Sleep(20 * time.Millisecond)
+		close(returned)
+		return syscall.EINTR
+	})
+	s, kernel := testSession(t, fs, Options{})
+	defer kernel.Close()
+
+	// a second connection, which fails once the kernel's end is closed
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serve(&conn{session: s, dev: os.NewFile(uintptr(fds[0]), "clone")})
+	if err := unix.Close(fds[1]); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.errMu.Lock()
+		n := len(s.errs)
+		s.errMu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second connection did not fail")
+		}
+	}
+
+	abortErr := errors.New("abort failed")
+	aborted := 0
+	s.abort = func() error {
+		aborted++
+		return abortErr
+	}
+
+	send(t, kernel, proto.GETATTR, 2, &proto.GetattrIn{})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.close(ctx)
+
+	if aborted != 1 {
+		t.Errorf("expected a single abort, got %d", aborted)
+	}
+	if err := <-cancelled; err == nil {
+		t.Error("in-flight request was not cancelled")
+	}
+	if _, ok := err.(ErrorList); !ok {
+		t.Fatalf("expected an ErrorList, got %T: %v", err, err)
+	}
+	if !errors.Is(err, abortErr) || !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, io.EOF) {
+		t.Errorf("missing errors from %v", err)
+	}
+}
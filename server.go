@@ -3,13 +3,19 @@ package fuse
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
-	ErrServerClosed = errors.New("fuse: server closed")
+	ErrServerClosed  = errors.New("fuse: server closed")
+	ErrInvalidOption = errors.New("fuse: invalid option")
 )
 
 const (
@@ -18,6 +24,78 @@ const (
 	stop
 )
 
+// MountError is returned by Serve when the mount helper fails to mount the
+// filesystem, such as when it rejects one of the mount options.
+type MountError struct {
+	Target  string
+	Options string
+
+	// message reported by the mount helper
+	Msg string
+	Err error
+}
+
+func (e *MountError) Error() string {
+	msg := e.Msg
+	if msg == "" {
+		msg = e.Err.Error()
+	}
+	return fmt.Sprintf("fuse: mount %s -o %q: %s", e.Target, e.Options, msg)
+}
+
+func (e *MountError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorList is returned when more than one error is encountered, such as by
+// each of the session's connections during Shutdown.
+type ErrorList []error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether any error in the list matches target, for errors.Is.
+func (l ErrorList) Is(target error) bool {
+	for _, err := range l {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error in the list that matches target, for errors.As.
+func (l ErrorList) As(target interface{}) bool {
+	for _, err := range l {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorList returns the non-nil errors, or nil if there are none
+func errorList(errs ...error) error {
+	var l ErrorList
+	for _, err := range errs {
+		if err != nil {
+			l = append(l, err)
+		}
+	}
+	switch len(l) {
+	case 0:
+		return nil
+	case 1:
+		return l[0]
+	}
+	return l
+}
+
 type Logger interface {
 	Printf(format string, args ...interface{})
 }
@@ -35,34 +113,131 @@ type Options struct {
 	DebugLog Logger
 
 	// mount options
+
+	// DefaultPermissions enables permission checking by the kernel, based on
+	// the file mode.
 	DefaultPermissions bool
-	AllowOther         bool
-	RootMode           uint32
-	BlockDevice        bool
-	BlockSize          int
-	MaxRead            int
-	FD                 int
-	UID                int
-	GID                int
-	FSName             string
-	SubType            string
+
+	// AllowOther allows users other than the mounting user to access the
+	// filesystem.
+	AllowOther bool
+
+	// BlockDevice mounts a filesystem backed by the block device FSName, with
+	// the given BlockSize.
+	BlockDevice bool
+	BlockSize   int
+
+	// MaxRead limits the size of read requests.
+	MaxRead int
+
+	// FD and Device serve a FUSE device that has already been mounted, such
+	// as by a supervisor, instead of mounting target. Serve duplicates the
+	// descriptor and sets it to non-blocking mode. The duplicate shares the
+	// original's open file description, so the caller's descriptor becomes
+	// non-blocking too. A target of the form /dev/fd/N is equivalent to
+	// setting FD to N.
+	//
+	// The filesystem is then never unmounted by the Server, which is the
+	// caller's responsibility.
+	FD     int
+	Device *os.File
+
+	// RootMode, UID and GID describe the root of the filesystem when mounting
+	// directly with mount(2). They default to the mode of the target, and the
+	// current user and group.
+	RootMode uint32
+	UID      int
+	GID      int
+
+	// FSName and SubType name the filesystem in the mount table, which is
+	// shown as "FSName on target type fuse.SubType".
+	FSName  string
+	SubType string
 
 	// libfuse options
-	AllowRoot   bool
+
+	// AllowRoot allows root to access the filesystem, in addition to the
+	// mounting user. Requests from other users are rejected with EACCES.
+	AllowRoot bool
+
+	// AutoUnmount unmounts the filesystem when the process exits, even if
+	// it has not called Shutdown.
 	AutoUnmount bool // can we make this default behavior? It's convenient.
+
+	// session options. Zero values select the defaults.
+
+	// DisableCloneFD prevents additional readers from cloning the FUSE device,
+	// so that every reader shares a single file descriptor.
+	DisableCloneFD bool
+
+	// MaxWorkers limits the number of requests handled concurrently.
+	// Defaults to 32.
+	MaxWorkers int
+
+	// MinReaders and MaxReaders bound the number of connections reading from
+	// the device. Defaults to 1 and 4.
+	MinReaders int
+	MaxReaders int
+
+	// ReadTimeout is how long an additional reader may wait for a request
+	// before it is reclaimed. Defaults to 15 seconds. Negative disables it.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is how long a reply may take to be written to the device.
+	// Defaults to 1 second. Negative disables it.
+	WriteTimeout time.Duration
+
+	// RequestTimeout sets the deadline of each request's Context, after which
+	// it is cancelled with context.DeadlineExceeded. By default, requests
+	// have no deadline.
+	RequestTimeout time.Duration
+
+	// init options, sent to the kernel during protocol negotiation. Zero
+	// values select the defaults. Filesystem.Init may further adjust them.
+
+	// MaxBackground is the maximum number of outstanding background requests,
+	// such as readahead and asynchronous writes. Defaults to 16.
+	MaxBackground uint16
+
+	// CongestionThreshold is the number of background requests at which the
+	// kernel considers the filesystem congested. Defaults to 3/4 of
+	// MaxBackground.
+	CongestionThreshold uint16
+
+	// MaxWrite is the maximum size of a single write request. Defaults to
+	// MaxPages pages.
+	MaxWrite uint32
+
+	// MaxPages is the maximum number of pages in a single read or write
+	// request. Defaults to 32, and cannot exceed 256.
+	MaxPages uint16
+
+	// TimeGran is the granularity of timestamps supported by the filesystem.
+	// Must be a power of 10 between 1ns and 1s. Defaults to 1ns.
+	TimeGran time.Duration
 }
 
 type Server struct {
 	Options Options
 
-	// mounted directory
+	// mounted directory, and the device number of its mount
 	target string
+	device int
 
 	// directory created by the server
 	created string
 
+	// closed once unmounted, if AutoUnmount is set
+	monitor io.Closer
+
 	state uint32
 
+	// closed once the session ends, for the reason in err. mu also guards
+	// session for notifications.
+	mu   sync.Mutex
+	done chan struct{}
+	err  error
+
 	*logger
 	session *session
 }
@@ -71,6 +246,9 @@ type Server struct {
 // if necessary. Blocks until the session has been initialized and is accepting
 // filesystem requests.
 //
+// If Options.FD or Options.Device is set, or target is of the form /dev/fd/N,
+// the given device is served and nothing is mounted.
+//
 // ErrServerClosed is returned after a call to Shutdown, or on subsequent calls
 // to Serve.
 func (s *Server) Serve(fs Filesystem, target string) (err error) {
@@ -95,6 +273,36 @@ func (s *Server) Serve(fs Filesystem, target string) (err error) {
 		}
 	}()
 
+	opts, err := newOpts(&s.Options)
+	if err != nil {
+		return err
+	}
+
+	session := &session{
+		logger:     s.logger,
+		fs:         fs,
+		opts:       opts,
+		requests:   make(map[uint64]*Context),
+		interrupts: make(map[uint64]uint64),
+		retrieves:  make(map[uint64]chan []byte),
+		done:       make(chan struct{}),
+		starved:    make(chan struct{}, 1),
+		ended:      s.end,
+	}
+
+	dev, err := device(&s.Options, target)
+	if err != nil {
+		return err
+	}
+	if dev != nil {
+		// not dev.Fd(), which would make it blocking and disable deadlines
+		s.debugf("serving a pre-opened device, unmounting is left to the caller")
+		s.mu.Lock()
+		s.session = session
+		s.mu.Unlock()
+		return session.start(dev)
+	}
+
 	if _, err = os.Stat(target); errors.Is(err, os.ErrNotExist) {
 		s.debugf("%s", err)
 		s.debugf("mkdir %s -m 755", target)
@@ -104,40 +312,54 @@ func (s *Server) Serve(fs Filesystem, target string) (err error) {
 		s.created = target
 	}
 
-	// attempt to clean up any existing mounts
+	// attempt to clean up a FUSE mount left behind at the target, such as by
+	// a server that exited without unmounting. Other mounts are left alone.
 	// todo: abort via fusectl?
-	_ = umount(target)
+	if _, err := deviceNumber(target); err == nil {
+		s.debugf("unmounting existing mount at %s", target)
+		_ = umount(target, false)
+	}
 
 	s.debugf("mounting target %s", target)
-	dev, err := mount(target)
+	dev, monitor, err := mount(target, &s.Options)
 	if err != nil {
 		return err
 	}
 	s.target = target
-	s.session = &session{
-		logger:  s.logger,
-		fs:      fs,
-		opts:    defaultOpts,
-		errc:    make(chan error, 1),
-		sem:     semaphore{},
-		done:    make(chan struct{}),
-		starved: make(chan struct{}, 1),
+	s.device, _ = deviceNumber(target)
+	s.monitor = monitor
+	s.mu.Lock()
+	s.session = session
+	s.mu.Unlock()
+	session.abort = func() error {
+		dev, err := deviceNumber(target)
+		if err != nil {
+			return err
+		}
+		return fusectl_abort(dev)
 	}
-	return s.session.start(dev)
+	return session.start(dev)
 }
 
 // Shutdown gracefully shuts down the FUSE server without interrupt any active
 // connections. Shutdown stops listening to requests and waits indefinitely for
-// each connection to become idle before closing it. Any directories or mounts
-// that were created by Serve will be removed.
+// in-flight requests to complete, before closing each connection. Any
+// directories or mounts that were created by Serve will be removed.
+//
+// A device given with Options.FD, Options.Device or a /dev/fd/N target is
+// closed, but its filesystem is not unmounted. The caller must unmount it.
 //
 // After Shutdown is called, future calls to Serve and Shutdown will return
 // ErrServerClosed.
 //
 // If the provided context expires before a graceful shutdown can complete,
-// Shutdown will forcefully abort the active fuse session.
+// Shutdown will forcefully abort the active fuse session. The Context of each
+// in-flight request is cancelled, the kernel fails any outstanding requests,
+// and the target is lazily unmounted. Aborting requires fusectl, mounted at
+// /sys/fs/fuse/connections.
 //
-// Returns any error encountered from the Server's connections.
+// Returns any error encountered from the Server's connections, as an ErrorList
+// if there is more than one.
 func (s *Server) Shutdown(ctx context.Context) error {
 	if !atomic.CompareAndSwapUint32(&s.state, serve, stop) {
 		return ErrServerClosed
@@ -150,9 +372,21 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		errs = append(errs, s.session.close(ctx))
 	}
 
-	if s.target != "" {
+	// the kernel has already unmounted the filesystem
+	if s.session != nil {
+		switch s.session.reason {
+		case ErrUnmounted, ErrDestroyed:
+			s.target = ""
+		}
+	}
+
+	if s.target != "" && s.mounted() {
 		s.debugf("unmounting target %s", s.target)
-		errs = append(errs, umount(s.target))
+		errs = append(errs, umount(s.target, ctx.Err() != nil))
+	}
+
+	if s.monitor != nil {
+		errs = append(errs, s.monitor.Close())
 	}
 
 	if s.created != "" {
@@ -160,13 +394,57 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		errs = append(errs, os.Remove(s.created))
 	}
 
-	// report first error encountered
-	for _, err := range errs {
-		if err != nil {
-			return err
-		}
+	s.end(ErrServerClosed)
+	return errorList(errs...)
+}
+
+// mounted reports whether the target is still covered by the server's mount,
+// rather than unmounted, or replaced by another one
+func (s *Server) mounted() bool {
+	device, err := deviceNumber(s.target)
+	return err == nil && (s.device == 0 || device == s.device)
+}
+
+// Done returns a channel that is closed when the session ends, either after a
+// call to Shutdown, or when the filesystem is unmounted, destroyed or aborted
+// by the kernel. Once Done is closed, Err reports why.
+//
+// Shutdown must still be called to release the Server's resources.
+func (s *Server) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// Err returns nil if Done is not yet closed. Otherwise, it returns the reason
+// the session ended: ErrServerClosed after Shutdown, ErrUnmounted when the
+// filesystem was unmounted externally, ErrDestroyed when the kernel destroyed
+// the filesystem, ErrAborted when the connection was aborted, or the error
+// encountered when reading from the FUSE device.
+func (s *Server) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// end the session with the given reason. Only the first call has any effect.
+func (s *Server) end(reason error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	s.err = reason
+	if s.done == nil {
+		s.done = closedchan
+	} else {
+		close(s.done)
 	}
-	return nil
 }
 
 type logger struct {
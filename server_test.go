@@ -0,0 +1,96 @@
+package fuse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bytelog.org/fuse/proto"
+)
+
+func TestErrorList(t *testing.T) {
+	if err := errorList(nil, nil); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if err := errorList(nil, ErrServerClosed); err != ErrServerClosed {
+		t.Errorf("expected a single error, got %v", err)
+	}
+
+	pathErr := &os.PathError{Op: "umount", Path: "/mnt", Err: ENOENT}
+	err := errorList(ErrServerClosed, pathErr)
+	if _, ok := err.(ErrorList); !ok {
+		t.Fatalf("expected an ErrorList, got %T", err)
+	}
+	if !errors.Is(err, ErrServerClosed) || !errors.Is(err, ENOENT) || errors.Is(err, EPROTO) {
+		t.Errorf("unexpected errors.Is results for %v", err)
+	}
+	var target *os.PathError
+	if !errors.As(err, &target) || target != pathErr {
+		t.Errorf("errors.As did not find %v", pathErr)
+	}
+}
+
+func TestServerEnd(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		end    func(t *testing.T, s *session, kernel *os.File)
+		reason error
+	}{
+		{"destroy", func(t *testing.T, s *session, kernel *os.File) {
+			send(t, kernel, proto.DESTROY, 2, nil)
+			if h := recv(t, kernel); h.Unique != 2 || h.Error != 0 {
+				t.Errorf("unexpected reply: %+v", h)
+			}
+		}, ErrDestroyed},
+		{"unmount", func(t *testing.T, s *session, kernel *os.File) { s.terminate(ErrUnmounted) }, ErrUnmounted},
+		{"abort", func(t *testing.T, s *session, kernel *os.File) { s.terminate(ErrAborted) }, ErrAborted},
+		{"device error", func(t *testing.T, s *session, kernel *os.File) { _ = kernel.Close() }, io.EOF},
+		{"shutdown", nil, ErrServerClosed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var destroyed int32
+			fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+				if ctx.Op == proto.DESTROY {
+					atomic.AddInt32(&destroyed, 1)
+				}
+				return DefaultFilesystem(ctx, req, resp)
+			})
+			sess, kernel := newTestSession(t, fs, Options{})
+			defer kernel.Close()
+
+			srv := &Server{state: serve, logger: sess.logger, session: sess}
+			sess.ended = srv.end
+			sess.serve(&conn{session: sess, dev: sess.dev})
+			done := srv.Done()
+
+			if tt.end != nil {
+				tt.end(t, sess, kernel)
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("Done should be closed once the session ends")
+				}
+				if err := srv.Err(); !errors.Is(err, tt.reason) {
+					t.Errorf("expected %v, got %v", tt.reason, err)
+				}
+			} else if srv.Err() != nil {
+				t.Fatalf("unexpected error before Shutdown: %v", srv.Err())
+			}
+
+			// only a failed device is reported as an error
+			if err := srv.Shutdown(context.Background()); (err != nil) != (tt.reason == io.EOF) {
+				t.Errorf("unexpected Shutdown error: %v", err)
+			}
+			if err := srv.Err(); !errors.Is(err, tt.reason) {
+				t.Errorf("expected %v after Shutdown, got %v", tt.reason, err)
+			}
+			if n := atomic.LoadInt32(&destroyed); n != 1 {
+				t.Errorf("expected a single Destroy, got %d", n)
+			}
+		})
+	}
+}
@@ -2,16 +2,23 @@ package fuse
 
 import (
 	"fmt"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"golang.org/x/sys/unix"
+
 	"bytelog.org/fuse/proto"
 )
 
 var (
-	ENOENT = syscall.ENOENT
-	ENOSYS = syscall.ENOSYS
-	EPROTO = syscall.EPROTO
+	ENODATA    = syscall.ENODATA
+	ENOENT     = syscall.ENOENT
+	ENOSYS     = syscall.ENOSYS
+	EOPNOTSUPP = syscall.EOPNOTSUPP
+	EPROTO     = syscall.EPROTO
+	ERANGE     = syscall.ERANGE
 )
 
 type Context struct {
@@ -21,12 +28,21 @@ type Context struct {
 	off  int
 	sess *session
 
-	// Request buffer begins here. NO ADDITIONAL FIELDS BELOW THIS LINE.
-	Header
-}
+	// whether the handler holds a worker, or gave it up to block
+	worker, yielded bool
+
+	// cancellation state, see context.go
+	mu          sync.Mutex
+	done        chan struct{}
+	err         error
+	intr        chan struct{}
+	interrupted bool
+	deadline    time.Time
+	timer       *time.Timer
+	gen         uint64
 
-func (ctx *Context) Interrupt() <-chan struct{} {
-	return nil
+	// points to the start of buf
+	*Header
 }
 
 func (ctx *Context) String() string {
@@ -42,13 +58,14 @@ func (ctx *Context) bytes(off uintptr) []byte {
 	return ctx.buf[headerInSize+off : ctx.off]
 }
 
-func (ctx *Context) string() string {
-	buf := ctx.bytes(0)
+// null terminated string in the request data, starting at off
+func (ctx *Context) string(off uintptr) string {
+	buf := ctx.bytes(off)
 	return string(buf[:strlen(buf)])
 }
 
-func (ctx *Context) strings(n int) []string {
-	buf := ctx.bytes(0)
+func (ctx *Context) strings(off uintptr, n int) []string {
+	buf := ctx.bytes(off)
 	s := make([]string, n)
 
 	for i := range s {
@@ -87,6 +104,15 @@ func (ctx *Context) outData() []byte {
 	return ctx.buf[ctx.off+int(headerOutSize):]
 }
 
+// response data buffer, truncated to at most size bytes
+func (ctx *Context) outLimit(size uint32) []byte {
+	buf := ctx.outData()
+	if uint32(len(buf)) > size {
+		buf = buf[:size]
+	}
+	return buf
+}
+
 func (ctx *Context) outHeader() *proto.OutHeader {
 	return (*proto.OutHeader)(unsafe.Pointer(&ctx.buf[ctx.off]))
 }
@@ -264,6 +290,19 @@ type SymlinkOut struct {
 	EntryOut
 }
 
+// nocast
+type CreateIn struct {
+	Name  string
+	Flags FileFlags
+	Mode  uint32
+	Umask uint32
+}
+
+type CreateOut struct {
+	EntryOut
+	OpenOut
+}
+
 // nocast
 type MknodIn struct {
 	Name  string
@@ -310,13 +349,60 @@ type LinkOut struct {
 	EntryOut
 }
 
+// FileFlags holds the flags passed to open(2).
+type FileFlags uint32
+
+func (f FileFlags) Accmode() uint32 { return uint32(f) & syscall.O_ACCMODE }
+func (f FileFlags) ReadOnly() bool  { return f.Accmode() == syscall.O_RDONLY }
+func (f FileFlags) WriteOnly() bool { return f.Accmode() == syscall.O_WRONLY }
+func (f FileFlags) ReadWrite() bool { return f.Accmode() == syscall.O_RDWR }
+func (f FileFlags) Create() bool    { return f&syscall.O_CREAT != 0 }
+func (f FileFlags) Excl() bool      { return f&syscall.O_EXCL != 0 }
+func (f FileFlags) Truncate() bool  { return f&syscall.O_TRUNC != 0 }
+func (f FileFlags) Append() bool    { return f&syscall.O_APPEND != 0 }
+func (f FileFlags) Nonblock() bool  { return f&syscall.O_NONBLOCK != 0 }
+func (f FileFlags) Dsync() bool     { return f&syscall.O_DSYNC != 0 }
+func (f FileFlags) Sync() bool      { return f&syscall.O_SYNC == syscall.O_SYNC }
+func (f FileFlags) Direct() bool    { return f&syscall.O_DIRECT != 0 }
+func (f FileFlags) Directory() bool { return f&syscall.O_DIRECTORY != 0 }
+func (f FileFlags) Noatime() bool   { return f&syscall.O_NOATIME != 0 }
+
+// OpenFlags are returned by Open, Opendir and Create to control how the kernel
+// treats an open file.
+type OpenFlags uint32
+
+const (
+	// bypass the page cache for this open file
+	OpenDirectIO OpenFlags = proto.FOPEN_DIRECT_IO
+
+	// don't invalidate the data cache on open
+	OpenKeepCache OpenFlags = proto.FOPEN_KEEP_CACHE
+
+	// the file is not seekable
+	OpenNonseekable OpenFlags = proto.FOPEN_NONSEEKABLE
+
+	// allow caching this directory
+	OpenCacheDir OpenFlags = proto.FOPEN_CACHE_DIR
+
+	// the file is stream-like (no file position at all)
+	OpenStream OpenFlags = proto.FOPEN_STREAM
+)
+
+func (f OpenFlags) DirectIO() bool    { return f&proto.FOPEN_DIRECT_IO != 0 }
+func (f OpenFlags) KeepCache() bool   { return f&proto.FOPEN_KEEP_CACHE != 0 }
+func (f OpenFlags) Nonseekable() bool { return f&proto.FOPEN_NONSEEKABLE != 0 }
+func (f OpenFlags) CacheDir() bool    { return f&proto.FOPEN_CACHE_DIR != 0 }
+func (f OpenFlags) Stream() bool      { return f&proto.FOPEN_STREAM != 0 }
+
 type OpenIn struct {
-	Flags uint32
+	Flags FileFlags
 	_     uint32
 }
 
 type OpenOut struct {
-	EntryOut
+	Fh        uint64
+	OpenFlags OpenFlags
+	_         uint32
 }
 
 type ReadIn struct {
@@ -325,7 +411,7 @@ type ReadIn struct {
 	Size      uint32
 	ReadFlags uint32
 	LockOwner uint64
-	Flags     uint32
+	Flags     FileFlags
 	_         uint32
 }
 
@@ -333,6 +419,61 @@ type ReadOut struct {
 	Data []byte
 }
 
+type WriteFlags uint32
+
+func (f WriteFlags) Cache() bool     { return f&proto.WRITE_CACHE != 0 }
+func (f WriteFlags) LockOwner() bool { return f&proto.WRITE_LOCKOWNER != 0 }
+func (f WriteFlags) KillPriv() bool  { return f&proto.WRITE_KILL_PRIV != 0 }
+
+// nocast
+type WriteIn struct {
+	Fh         uint64
+	Offset     uint64
+	WriteFlags WriteFlags
+
+	// only valid if WriteFlags.LockOwner() is set
+	LockOwner uint64
+	Flags     FileFlags
+
+	// Data points directly into the request buffer. It must not be retained
+	// after the handler returns.
+	Data []byte
+}
+
+type WriteOut struct {
+	// number of bytes written
+	Size uint32
+	_    uint32
+}
+
+type StatfsOut struct {
+	// total data blocks, in units of Frsize
+	Blocks uint64
+
+	// free blocks
+	Bfree uint64
+
+	// free blocks available to unprivileged users
+	Bavail uint64
+
+	// total inodes
+	Files uint64
+
+	// free inodes
+	Ffree uint64
+
+	// preferred block size for I/O
+	Bsize uint32
+
+	// maximum length of filenames
+	Namelen uint32
+
+	// fragment size
+	Frsize uint32
+	_      uint32
+	_      [6]uint32
+}
+
 type LseekIn struct {
 	Fh     uint64
 	Offset uint64
@@ -344,6 +485,29 @@ type LseekOut struct {
 	Offset uint64
 }
 
+// FallocateMode holds the fallocate(2) mode flags. The kernel only forwards
+// KeepSize, PunchHole and ZeroRange, and fails any other mode with EOPNOTSUPP.
+type FallocateMode uint32
+
+// KeepSize reports whether the file size must be left unchanged, even if the
+// range extends past the end of the file. Always set with PunchHole.
+func (m FallocateMode) KeepSize() bool { return m&unix.FALLOC_FL_KEEP_SIZE != 0 }
+
+// PunchHole reports whether the range must be deallocated, so that it reads
+// as zeros, rather than allocated.
+func (m FallocateMode) PunchHole() bool { return m&unix.FALLOC_FL_PUNCH_HOLE != 0 }
+
+// ZeroRange reports whether the range must be allocated and zeroed.
+func (m FallocateMode) ZeroRange() bool { return m&unix.FALLOC_FL_ZERO_RANGE != 0 }
+
+type FallocateIn struct {
+	Fh     uint64
+	Offset uint64
+	Length uint64
+	Mode   FallocateMode
+	_      uint32
+}
+
 type CopyFileRangeIn struct {
 	FhIn      uint64
 	OffIn     uint64
@@ -354,13 +518,208 @@ type CopyFileRangeIn struct {
 	Flags     uint64
 }
 
+type FlushIn struct {
+	Fh        uint64
+	_         uint32
+	_         uint32
+	LockOwner uint64
+}
+
+type FsyncFlags uint32
+
+// Datasync is set if only the file's data, not its metadata, must be synced.
+func (f FsyncFlags) Datasync() bool { return f&proto.FSYNC_FDATASYNC != 0 }
+
+type FsyncIn struct {
+	Fh         uint64
+	FsyncFlags FsyncFlags
+	_          uint32
+}
+
+type FileLock struct {
+	Start uint64
+
+	// inclusive end of the locked range
+	End uint64
+
+	// F_RDLCK, F_WRLCK or F_UNLCK
+	Type uint32
+	PID  uint32
+}
+
+type LkFlags uint32
+
+// Flock is set for BSD flock(2) locks, rather than POSIX record locks.
+func (f LkFlags) Flock() bool { return f&proto.LK_FLOCK != 0 }
+
+type LkIn struct {
+	Fh      uint64
+	Owner   uint64
+	Lk      FileLock
+	LkFlags LkFlags
+	_       uint32
+}
+
+type LkOut struct {
+	Lk FileLock
+}
+
+type ReleaseFlags uint32
+
+// Flush is set if the file should be flushed as part of the release.
+func (f ReleaseFlags) Flush() bool { return f&proto.RELEASE_FLUSH != 0 }
+
+// FlockUnlock is set if flock locks held by LockOwner must be released.
+func (f ReleaseFlags) FlockUnlock() bool { return f&proto.RELEASE_FLOCK_UNLOCK != 0 }
+
 type ReleaseIn struct {
 	Fh           uint64
-	Flags        uint32
-	ReleaseFlags uint32
+	Flags        FileFlags
+	ReleaseFlags ReleaseFlags
 	LockOwner    uint64
 }
 
+type OpendirIn struct {
+	Flags FileFlags
+	_     uint32
+}
+
+type OpendirOut struct {
+	Fh        uint64
+	OpenFlags OpenFlags
+	_         uint32
+}
+
+type ReaddirIn struct {
+	Fh     uint64
+	Offset uint64
+	Size   uint32
+	_      uint32
+	_      uint64
+	Flags  FileFlags
+	_      uint32
+}
+
+type Dirent struct {
+	Ino uint64
+
+	// Offset cookie of the next entry. The kernel passes it back in
+	// ReaddirIn.Offset to resume the listing after this entry.
+	Off uint64
+
+	// File type bits of the entry's mode. Permission bits are ignored.
+	Mode uint32
+
+	Name string
+}
+
+// ReaddirOut packs directory entries into the reply buffer.
+type ReaddirOut struct {
+	buf []byte
+	n   int
+}
+
+// Add appends ent to the reply. It returns false if the buffer is full, in
+// which case the entry has not been added and will be requested again in a
+// subsequent Readdir, starting from the last added entry's Off.
+func (out *ReaddirOut) Add(ent Dirent) bool {
+	n, ok := putDirent(out.buf[out.n:], ent)
+	out.n += n
+	return ok
+}
+
+type ReaddirplusIn struct {
+	Fh     uint64
+	Offset uint64
+	Size   uint32
+	_      uint32
+	_      uint64
+	Flags  FileFlags
+	_      uint32
+}
+
+// ReaddirplusOut packs directory entries, along with their lookup results,
+// into the reply buffer.
+type ReaddirplusOut struct {
+	buf []byte
+	n   int
+}
+
+// Add appends ent and its lookup result to the reply. It returns false if the
+// buffer is full, in which case the entry has not been added.
+//
+// Each added entry counts as a lookup of entry.Nodeid, unless entry.Nodeid is
+// zero or ent.Name is "." or "..". Implementations must account for the lookup
+// whenever Add returns true. If the reply is not delivered to the kernel, the
+// lookups are balanced with calls to Forget.
+func (out *ReaddirplusOut) Add(ent Dirent, entry EntryOut) bool {
+	const entrySize = int(unsafe.Sizeof(EntryOut{}))
+	buf := out.buf[out.n:]
+	if len(buf) < entrySize {
+		return false
+	}
+	n, ok := putDirent(buf[entrySize:], ent)
+	if !ok {
+		return false
+	}
+	*(*EntryOut)(unsafe.Pointer(&buf[0])) = entry
+	out.n += entrySize + n
+	return true
+}
+
+// forget balances the lookups implied by the entries added to out
+func (out *ReaddirplusOut) forget(ctx *Context, fs Filesystem) {
+	nodeid := ctx.NodeID
+	defer func() { ctx.NodeID = nodeid }()
+
+	for off := 0; off < out.n; {
+		ent := (*proto.Direntplus)(unsafe.Pointer(&out.buf[off]))
+		name := out.buf[off+int(proto.NAME_OFFSET_DIRENTPLUS):]
+		name = name[:ent.Dirent.Namelen]
+		off += int(proto.DirentAlign(proto.DirentplusSize(*ent)))
+
+		if ent.EntryOut.Nodeid == 0 || string(name) == "." || string(name) == ".." {
+			continue
+		}
+		ctx.NodeID = ent.EntryOut.Nodeid
+		fs.Forget(ctx, &ForgetIn{NLookup: 1})
+	}
+}
+
+func putDirent(buf []byte, ent Dirent) (int, bool) {
+	namelen := uint32(len(ent.Name))
+	size := int(proto.DirentAlign(proto.NAME_OFFSET + namelen))
+	if size > len(buf) {
+		return 0, false
+	}
+	*(*proto.Dirent)(unsafe.Pointer(&buf[0])) = proto.Dirent{
+		Ino:     ent.Ino,
+		Off:     ent.Off,
+		Namelen: namelen,
+		Type:    (ent.Mode & syscall.S_IFMT) >> 12,
+	}
+	n := int(proto.NAME_OFFSET) + copy(buf[proto.NAME_OFFSET:], ent.Name)
+	for i := range buf[n:size] {
+		buf[n+i] = 0
+	}
+	return size, true
+}
+
+type SetxattrFlags uint32
+
+func (f SetxattrFlags) Create() bool  { return f&unix.XATTR_CREATE != 0 }
+func (f SetxattrFlags) Replace() bool { return f&unix.XATTR_REPLACE != 0 }
+
+// nocast
+type SetxattrIn struct {
+	Name  string
+	Flags SetxattrFlags
+
+	// Value points directly into the request buffer. It must not be retained
+	// after the handler returns.
+	Value []byte
+}
+
 // nocast
 type GetxattrIn struct {
 	Name string
@@ -368,9 +727,117 @@ type GetxattrIn struct {
 
 // nocast
 type GetxattrOut struct {
+	// The complete attribute value. Size probes and ERANGE errors are handled
+	// by the library.
 	Value []byte
 }
 
+// nocast
+type ListxattrOut struct {
+	// The complete list of attribute names. Names are encoded by the library,
+	// which also handles size probes and ERANGE errors.
+	Names []string
+}
+
+// nocast
+type RemovexattrIn struct {
+	Name string
+}
+
+type IoctlFlags uint32
+
+// Compat reports whether the caller is a 32-bit process on a 64-bit kernel,
+// and Is32Bit whether its pointers and longs are 32 bits wide. Both apply to
+// x32 callers, which also set X32.
+func (f IoctlFlags) Compat() bool       { return f&proto.IOCTL_COMPAT != 0 }
+func (f IoctlFlags) Is32Bit() bool      { return f&proto.IOCTL_32BIT != 0 }
+func (f IoctlFlags) X32() bool          { return f&proto.IOCTL_COMPAT_X32 != 0 }
+func (f IoctlFlags) Unrestricted() bool { return f&proto.IOCTL_UNRESTRICTED != 0 }
+func (f IoctlFlags) Dir() bool          { return f&proto.IOCTL_DIR != 0 }
+
+// nocast
+type IoctlIn struct {
+	Fh    uint64
+	Flags IoctlFlags
+	Cmd   uint32
+
+	// The argument to ioctl(2), typically an address in the caller's memory
+	Arg uint64
+
+	// Data is read from the caller's memory. For restricted ioctls, it is the
+	// _IOC_SIZE(Cmd) bytes at Arg if Cmd has _IOC_WRITE set. After a retry,
+	// it is the requested input iovecs, concatenated in order.
+	//
+	// Data points directly into the request buffer. It must not be retained
+	// after the handler returns.
+	Data []byte
+
+	// The maximum size of IoctlOut.Data
+	OutSize uint32
+}
+
+// IoctlIovec is a region of the caller's memory
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+// nocast
+type IoctlOut struct {
+	// The result of ioctl(2). Errors, such as ENOTTY for an unsupported Cmd,
+	// are returned by the handler instead.
+	Result int32
+
+	// Data is written back to the caller's memory, at Arg for restricted
+	// ioctls, or spread across the output iovecs after a retry. It must not
+	// exceed IoctlIn.OutSize.
+	Data []byte
+
+	retry   bool
+	inIovs  []IoctlIovec
+	outIovs []IoctlIovec
+}
+
+// Retry asks the kernel to repeat an unrestricted ioctl, with the contents of
+// the in iovecs as IoctlIn.Data, and room for the out iovecs in IoctlOut.Data.
+// Unrestricted ioctls are typically retried once Cmd and Arg have been decoded,
+// possibly more than once to follow pointers held in the input. Result and
+// Data are ignored.
+//
+// Only unrestricted ioctls can be retried, and there may be no more than 256
+// iovecs in total.
+func (o *IoctlOut) Retry(in, out []IoctlIovec) {
+	o.retry = true
+	o.inIovs = in
+	o.outIovs = out
+}
+
+type PollFlags uint32
+
+// ScheduleNotify reports whether the kernel is waiting for a notification from
+// PollIn.Handle once the file becomes ready.
+func (f PollFlags) ScheduleNotify() bool { return f&proto.POLL_SCHEDULE_NOTIFY != 0 }
+
+// nocast
+type PollIn struct {
+	Fh    uint64
+	Flags PollFlags
+
+	// The requested poll(2) events, such as unix.POLLIN. Always zero for
+	// kernels older than protocol 7.21.
+	Events uint32
+
+	// Set if Flags.ScheduleNotify is set. The filesystem should retain it,
+	// and call Notify once any of the events become ready.
+	Handle *PollHandle
+}
+
+type PollOut struct {
+	// The ready poll(2) events, such as unix.POLLIN
+	Revents uint32
+	_       uint32
+}
+
 func strlen(n []byte) int {
 	for i := 0; i < len(n); i++ {
 		if n[i] == 0 {
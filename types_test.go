@@ -0,0 +1,63 @@
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"bytelog.org/fuse/proto"
+)
+
+func TestReaddirOut(t *testing.T) {
+	out := ReaddirOut{buf: make([]byte, 64)}
+
+	if !out.Add(Dirent{Ino: 1, Off: 1, Mode: syscall.S_IFDIR | 0755, Name: "."}) {
+		t.Fatal("first entry should fit")
+	}
+	if out.n != 32 {
+		t.Fatalf("expected aligned size 32, got %d", out.n)
+	}
+	if !out.Add(Dirent{Ino: 2, Off: 2, Mode: syscall.S_IFREG, Name: "abcdefgh"}) {
+		t.Fatal("second entry should fit")
+	}
+	if out.Add(Dirent{Ino: 3, Off: 3, Name: "x"}) {
+		t.Fatal("third entry should not fit")
+	}
+	if out.n != 64 {
+		t.Fatalf("expected size 64, got %d", out.n)
+	}
+
+	ent := (*proto.Dirent)(unsafe.Pointer(&out.buf[32]))
+	if ent.Ino != 2 || ent.Off != 2 || ent.Namelen != 8 || ent.Type != syscall.DT_REG {
+		t.Errorf("unexpected dirent: %+v", *ent)
+	}
+	if name := string(out.buf[32+proto.NAME_OFFSET : 32+proto.NAME_OFFSET+8]); name != "abcdefgh" {
+		t.Errorf("unexpected name %q", name)
+	}
+}
+
+func TestReaddirplusOutForget(t *testing.T) {
+	out := ReaddirplusOut{buf: make([]byte, 4096)}
+	out.Add(Dirent{Ino: 1, Off: 1, Name: "."}, EntryOut{Nodeid: 1})
+	out.Add(Dirent{Ino: 1, Off: 2, Name: ".."}, EntryOut{Nodeid: 1})
+	out.Add(Dirent{Ino: 5, Off: 3, Name: "file"}, EntryOut{Nodeid: 5})
+	out.Add(Dirent{Ino: 6, Off: 4, Name: "noattr"}, EntryOut{})
+	out.Add(Dirent{Ino: 7, Off: 5, Name: "other"}, EntryOut{Nodeid: 7})
+
+	forgotten := map[uint64]uint64{}
+	fs := HandlerFunc(func(ctx *Context, req Request, resp Response) error {
+		forgotten[ctx.NodeID] += req.(*ForgetIn).NLookup
+		return nil
+	})
+
+	ctx := &Context{Header: &Header{}}
+	ctx.NodeID = 1
+	out.forget(ctx, fs)
+
+	if len(forgotten) != 2 || forgotten[5] != 1 || forgotten[7] != 1 {
+		t.Errorf("unexpected forgets: %v", forgotten)
+	}
+	if ctx.NodeID != 1 {
+		t.Errorf("NodeID not restored: %d", ctx.NodeID)
+	}
+}